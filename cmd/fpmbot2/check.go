@@ -0,0 +1,130 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readYAMLStrict is like readYAML but rejects unknown keys
+func readYAMLStrict(file string, object interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(object)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// check validates the repository file and the package descriptions without
+// building anything. The descriptions are checked against the schema, then
+// the fpmbuild part of each valid description is checked by fpmbuild -check.
+func check(repofname string, datadir string) (res int) {
+	repodir, repoyaml, err := repoPaths(repofname, datadir)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var repo Repository
+	err = readYAMLStrict(repoyaml, &repo)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	invalidDefaults, invalid, err := validateRepository(&repo, repoyaml, repodir+".src")
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if invalidDefaults != nil {
+		log.Println(invalidDefaults)
+		return 1
+	}
+
+	tmpdir, err := ioutil.TempDir("", "fpmbot2-check")
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(tmpdir)
+	srcdir := filepath.Join(tmpdir, "src")
+	err = os.Mkdir(srcdir, 0777)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	defaults, err := repo.defaults(repoyaml)
+	if err == nil {
+		err = writeFPMBuildConfig(filepath.Join(tmpdir, defaultsFile), defaults.Node)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	for _, item := range repo.Packages {
+		name := item.Name
+		if err := invalid[name]; err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
+
+		desc, err := repo.packageDescription(item, repoyaml, repodir+".src")
+		if os.IsNotExist(err) {
+			log.Printf("Package %s: no description", name)
+			continue
+		} else if err != nil {
+			log.Printf("Package %s: %v", name, err)
+			res += 1
+			continue
+		}
+
+		gitpkg, err := decodePackage(defaults, desc)
+		if err == nil {
+			_, err = gitpkg.Source("")
+		}
+		if err != nil {
+			log.Printf("Package %s: %v", name, err)
+			res += 1
+			continue
+		}
+
+		config := filepath.Join(tmpdir, name+".fpmbuild.yaml")
+		err = writeFPMBuildConfig(config, desc.Node)
+		if err != nil {
+			log.Printf("Package %s: %v", name, err)
+			res += 1
+			continue
+		}
+
+		args := []string{"-check", "-config", filepath.Join(tmpdir, defaultsFile), "-config", config, srcdir}
+		log.Printf("Package %s: fpmbuild %s", name, strings.Join(args, " "))
+		cmd := exec.Command("fpmbuild", args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			log.Printf("Package %s: %v", name, err)
+			res += 1
+		}
+	}
+	return res
+}
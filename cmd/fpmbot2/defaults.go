@@ -0,0 +1,107 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+	"internal/fpmconfig"
+)
+
+// PackageList is the packages mapping of the repository file, in order
+type PackageList []Package
+
+// Package is a package of the repository file. Value is its description, nil
+// if the package has none.
+type Package struct {
+	Name  string
+	Value *yaml.Node
+}
+
+func (l *PackageList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: packages must be a mapping", n.Line)
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		item := Package{Name: n.Content[i].Value, Value: n.Content[i+1]}
+		if fpmconfig.IsNull(item.Value) {
+			item.Value = nil
+		}
+		*l = append(*l, item)
+	}
+	return nil
+}
+
+// defaultsFile is the fpmbuild configuration of the repository defaults in the
+// source directory, given to fpmbuild before the package configuration
+const defaultsFile = "_defaults.fpmbuild.yaml"
+
+// packageDescription returns the description of a package: its value in the
+// repository file, or the existing <name>.yaml of the source directory. If
+// there is none, the description is empty when the repository has defaults.
+func (repo *Repository) packageDescription(item Package, repoyaml, reposrcdir string) (*fpmconfig.Layer, error) {
+	if item.Value != nil {
+		return fpmconfig.NodeLayer(repoyaml, item.Value)
+	}
+	file := filepath.Join(reposrcdir, item.Name+".yaml")
+	layer, err := fpmconfig.ReadLayer(file)
+	if os.IsNotExist(err) && !fpmconfig.IsNull(&repo.Defaults) {
+		return fpmconfig.NodeLayer(file, nil)
+	}
+	return layer, err
+}
+
+// defaults returns the defaults of the repository file
+func (repo *Repository) defaults(repoyaml string) (*fpmconfig.Layer, error) {
+	return fpmconfig.NodeLayer(repoyaml, &repo.Defaults)
+}
+
+// decodePackage merges the fpmbot2 keys of the repository defaults and of the
+// package description the same way fpmbuild merges its configuration layers
+func decodePackage(defaults, desc *fpmconfig.Layer) (gitpkg GitPackage, err error) {
+	var layers []*fpmconfig.Layer
+	for _, layer := range []*fpmconfig.Layer{defaults, desc} {
+		git, _ := splitDescription(layer.Node)
+		layers = append(layers, &fpmconfig.Layer{Name: layer.Name, Node: git})
+	}
+	_, err = fpmconfig.MergeLayers(layers, &gitpkg)
+	return gitpkg, err
+}
+
+// splitDescription splits a package description in the keys understood by
+// fpmbot2 (GitPackage) and the configuration given to fpmbuild
+func splitDescription(desc *yaml.Node) (git, fpmbuild *yaml.Node) {
+	keys := gitPackageKeys()
+	git = &yaml.Node{Kind: yaml.MappingNode, Line: desc.Line}
+	fpmbuild = &yaml.Node{Kind: yaml.MappingNode, Line: desc.Line}
+	for i := 0; i+1 < len(desc.Content); i += 2 {
+		if keys[desc.Content[i].Value] {
+			git.Content = append(git.Content, desc.Content[i], desc.Content[i+1])
+		} else {
+			fpmbuild.Content = append(fpmbuild.Content, desc.Content[i], desc.Content[i+1])
+		}
+	}
+	return git, fpmbuild
+}
+
+// writeFPMBuildConfig writes the fpmbuild part of a package description
+func writeFPMBuildConfig(file string, desc *yaml.Node) error {
+	_, config := splitDescription(desc)
+	return writeYAML(file, config)
+}
+
+// gitPackageKeys returns the keys of the package description that are only
+// understood by fpmbot2
+func gitPackageKeys() map[string]bool {
+	keys := map[string]bool{}
+	t := reflect.TypeOf(GitPackage{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := fpmconfig.YAMLName(t.Field(i)); name != "" {
+			keys[name] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,57 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	"internal/fpmconfig"
+)
+
+func testLayer(t *testing.T, name, data string) *fpmconfig.Layer {
+	var doc yaml.Node
+	err := yaml.Unmarshal([]byte(data), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var node *yaml.Node
+	if len(doc.Content) > 0 {
+		node = doc.Content[0]
+	}
+	layer, err := fpmconfig.NodeLayer(name, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func TestDecodePackage(t *testing.T) {
+	defaults := `{git: url, ref: main, depth: 1, watch: [a], fpm: [x]}`
+	tests := []struct {
+		desc string
+		want GitPackage
+	}{
+		{``, GitPackage{GitURL: "url", Ref: "main", Depth: 1, Watch: []string{"a"}}},
+		{`{ref: dev, build: {build: make}}`, GitPackage{GitURL: "url", Ref: "dev", Depth: 1, Watch: []string{"a"}}},
+		{`{watch: [b]}`, GitPackage{GitURL: "url", Ref: "main", Depth: 1, Watch: []string{"b"}}},
+		{`{watch: !append [b]}`, GitPackage{GitURL: "url", Ref: "main", Depth: 1, Watch: []string{"a", "b"}}},
+		{`{ref: !remove , depth: !remove }`, GitPackage{GitURL: "url", Watch: []string{"a"}}},
+		{`{git: !replace other}`, GitPackage{GitURL: "other", Ref: "main", Depth: 1, Watch: []string{"a"}}},
+	}
+	for _, test := range tests {
+		got, err := decodePackage(testLayer(t, "defaults", defaults), testLayer(t, "desc", test.desc))
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestDecodePackageInvalid(t *testing.T) {
+	_, err := decodePackage(testLayer(t, "defaults", `{depth: x}`), testLayer(t, "desc", ``))
+	if err == nil || err.Error() != `defaults:1: depth: expected an integer, got "x"` {
+		t.Errorf("got %v", err)
+	}
+}
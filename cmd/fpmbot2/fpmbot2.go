@@ -3,10 +3,8 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,18 +13,34 @@ import (
 	"strings"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Repository struct {
-	Target   string        `yaml:"target"`
-	Packages yaml.MapSlice `yaml:"packages"`
+	Target   string      `yaml:"target" doc:"fpm target (deb, rpm, ...), overridden by the -t option"`
+	Defaults yaml.Node   `yaml:"defaults" doc:"Package description merged under every package description"`
+	Packages PackageList `yaml:"packages" doc:"Package descriptions by package name"`
 }
 
+// GitPackage is the source of a package. Only one of git, hg, svn, tarball or
+// path can be specified.
 type GitPackage struct {
-	GitURL string `yaml:"git"`
-	Subdir string `yaml:"dir"`
-	Ref    string `yaml:"ref"`
+	GitURL     string         `yaml:"git" doc:"Git repository URL"`
+	HgURL      string         `yaml:"hg" doc:"Mercurial repository URL"`
+	SvnURL     string         `yaml:"svn" doc:"Subversion repository URL"`
+	Tarball    string         `yaml:"tarball" doc:"URL of a tar or zip archive"`
+	SHA256     string         `yaml:"sha256" doc:"SHA-256 sum of the archive, required with tarball"`
+	Path       string         `yaml:"path" doc:"Local directory, relative to the repository file"`
+	Subdir     string         `yaml:"dir" doc:"Subdirectory of the source containing the package"`
+	Ref        string         `yaml:"ref" doc:"Reference to build: git ref (default is HEAD), hg revision (default is default) or svn revision (default is HEAD)"`
+	Track      string         `yaml:"track" doc:"ref (default) to build ref, or tags to build the newest tag matching tag-pattern and tag-regexp (git only)"`
+	TagPattern string         `yaml:"tag-pattern" doc:"Glob pattern of the tags to build with track: tags (for example v*)"`
+	TagRegexp  string         `yaml:"tag-regexp" doc:"Regular expression of the tags to build with track: tags"`
+	Depth      int            `yaml:"depth" doc:"Fetch only this number of commits (shallow clone, git only)"`
+	SingleRef  bool           `yaml:"single-ref" doc:"Fetch only ref, or only the tags with track: tags, instead of all the refs (git only)"`
+	Filter     string         `yaml:"filter" doc:"Partial clone filter, for example blob:none (git only)"`
+	Watch      []string       `yaml:"watch" doc:"Paths outside dir the package depends on. With dir, the package is only rebuilt when dir or these paths change (git only)"`
+	Verify     *VerifyOptions `yaml:"verify" doc:"Require a signature of the commit, or of the tag with track: tags, from these keys (git only)"`
 }
 
 func readYAML(file string, object interface{}) error {
@@ -42,32 +56,19 @@ func readYAML(file string, object interface{}) error {
 	return yaml.Unmarshal(data, object)
 }
 
-func hashFile(file string) (string, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	h := sha1.New()
-	_, err = io.Copy(h, f)
-	if err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
-
 func writeYAML(file string, object interface{}) error {
-	data, err := yaml.Marshal(object)
+	f, err := os.Create(file)
 	if err != nil {
 		return err
 	}
-	f, err := os.Create(file)
+	defer f.Close()
+	enc := yaml.NewEncoder(f)
+	enc.SetIndent(2)
+	err = enc.Encode(object)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(data)
-	return err
+	return enc.Close()
 }
 
 func main() {
@@ -77,23 +78,57 @@ func main() {
 	targetOpt := flag.String("t", "", "FPM target")
 	sudoOpt := flag.Bool("sudo", false, "Use sudo in fpmbuild")
 	datadirOpt := flag.String("datadir", "", "Data directory")
+	knownHostsOpt := flag.String("known-hosts", "", "known_hosts file to check git servers against")
+	checkOpt := flag.Bool("check", false, "Validate the repository files without building")
+	schemaOpt := flag.Bool("schema", false, "Print the JSON Schema of the repository file and exit")
+	sel := Selection{Only: namesFlag{}, Skip: namesFlag{}}
+	flag.Var(sel.Only, "only", "Build only these packages (comma separated, can be repeated)")
+	flag.Var(sel.Skip, "skip", "Do not build these packages (comma separated, can be repeated)")
+	flag.BoolVar(&sel.Force, "force", false, "Rebuild the selected packages even if unchanged")
+	planOpt := flag.Bool("plan", false, "Fetch the sources and tell which packages would be rebuilt, without building")
+	pruneOpt := flag.Bool("prune-sources", false, "Delete the sources of the packages no longer in the repository")
 	flag.Parse()
 	args := flag.Args()
 
+	if *schemaOpt {
+		schema, err := Schema()
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		fmt.Println(string(schema))
+		return
+	}
+
+	if *checkOpt {
+		for _, arg := range args {
+			res += check(arg, *datadirOpt)
+		}
+		return
+	}
+
+	if *knownHostsOpt != "" {
+		knownHosts, err := filepath.Abs(*knownHostsOpt)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		os.Setenv("GIT_SSH_COMMAND", sshCommand(knownHosts))
+	}
+
 	for _, arg := range args {
-		res += run(arg, *targetOpt, *sudoOpt, *datadirOpt)
+		res += run(arg, *targetOpt, *sudoOpt, *datadirOpt, &sel, *planOpt, *pruneOpt)
 	}
 }
-func run(repofname string, target string, sudo bool, datadir string) (res int) {
-	var repo Repository
-	var repodir string
-	var repoyaml string
 
+// repoPaths returns the repository directory prefix and the repository file
+// from the command line argument
+func repoPaths(repofname string, datadir string) (repodir string, repoyaml string, err error) {
 	st, st_err := os.Stat(repofname)
 	if st_err != nil && (!os.IsNotExist(st_err) || datadir == "") {
-		log.Println(st_err)
-		res = 1
-		return
+		return "", "", st_err
 	} else if datadir != "" && st_err != nil {
 		repodir = filepath.Join(datadir, repofname)
 		repoyaml = filepath.Join(repodir+".src", "_repo.yaml")
@@ -112,8 +147,20 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 			repodir = filepath.Join(datadir, filepath.Base(repodir))
 		}
 	}
+	return repodir, repoyaml, nil
+}
+
+func run(repofname string, target string, sudo bool, datadir string, sel *Selection, plan bool, prune bool) (res int) {
+	var repo Repository
+
+	repodir, repoyaml, err := repoPaths(repofname, datadir)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
 
-	err := readYAML(repoyaml, &repo)
+	err = readYAMLStrict(repoyaml, &repo)
 	if err != nil {
 		log.Println(err)
 		res = 1
@@ -122,13 +169,35 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 	if target == "" {
 		target = repo.Target
 	}
+	err = sel.check(&repo)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+
+	// Invalid packages are not built, invalid defaults stop everything
+	invalidDefaults, invalid, err := validateRepository(&repo, repoyaml, fmt.Sprintf("%s.src", repodir))
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	if invalidDefaults != nil {
+		log.Println(invalidDefaults)
+		res = 1
+		return
+	}
 
 	repotargetdir := fmt.Sprintf("%s.%s", repodir, target)
 	reposrcdir := fmt.Sprintf("%s.src", repodir)
+	repostoredir := fmt.Sprintf("%s.cache", repodir)
 	repopkgdir := fmt.Sprintf("%s.%s", repotargetdir, time.Now().Format("20060102-150405"))
 	log.Printf("Starting fpmbot2...")
 	log.Printf("Building packages from %s", reposrcdir)
-	log.Printf("Writing packages to %s", repopkgdir)
+	if !plan {
+		log.Printf("Writing packages to %s", repopkgdir)
+	}
 
 	repoprevdir, err := os.Readlink(repotargetdir)
 	if err != nil && !os.IsNotExist(err) {
@@ -150,25 +219,184 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 		return
 	}
 
+	// The defaults are given to fpmbuild as a layer under the package
+	defaults, err := repo.defaults(repoyaml)
+	if err == nil {
+		err = writeFPMBuildConfig(filepath.Join(reposrcdir, defaultsFile), defaults.Node)
+	}
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+
+	// Packages of the previous build no longer in the repository
+	removed, err := removedPackages(&repo, repoprevdir)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	removedSet := map[string]bool{}
+	for _, name := range removed {
+		removedSet[name] = true
+	}
+
+	// Sources of packages no longer in the repository
+	var stale map[string][]string
+	pruned := map[string]bool{}
+
+	// Packages without status in the report failed
+	statuses := map[string]string{}
+	defer func() {
+		if plan {
+			log.Println("Plan:")
+		} else {
+			log.Println("Build report:")
+		}
+		for _, item := range repo.Packages {
+			name := item.Name
+			status, ok := statuses[name]
+			if !ok {
+				status = "failed"
+			}
+			log.Printf("  %s: %s", name, status)
+		}
+		for _, name := range removed {
+			switch {
+			case pruned[name]:
+				log.Printf("  %s: removed, sources deleted", name)
+			case stale[name] != nil:
+				log.Printf("  %s: removed, sources left (see -prune-sources)", name)
+			default:
+				log.Printf("  %s: removed", name)
+			}
+		}
+	}()
+
+	// Packages fetching from the same git URL with the same options share
+	// their objects
+	gitCaches := map[string]int{}
+	// Files used by the packages, that might be in the source directory. If
+	// a package cannot be read they are unknown and nothing is pruned.
+	var used []string
+	var unreadable []string
 	for _, item := range repo.Packages {
-		name := item.Key.(string)
+		desc, err := repo.packageDescription(item, repoyaml, reposrcdir)
+		if err != nil {
+			unreadable = append(unreadable, item.Name)
+			continue
+		}
+		gitpkg, err := decodePackage(defaults, desc)
+		if err != nil {
+			unreadable = append(unreadable, item.Name)
+			continue
+		}
+		if gitpkg.Path != "" {
+			if path, err := absPath(filepath.Dir(repoyaml), gitpkg.Path); err == nil {
+				used = append(used, path)
+			} else {
+				unreadable = append(unreadable, item.Name)
+			}
+		}
+		if gitpkg.Verify != nil {
+			if gitpkg.Verify.resolve(filepath.Dir(repoyaml)) == nil {
+				used = append(used, gitpkg.Verify.GPGKeys...)
+				used = append(used, gitpkg.Verify.SSHAllowedSigners)
+			} else {
+				unreadable = append(unreadable, item.Name)
+			}
+		}
+		if git, err := gitpkg.Source(""); err == nil && git != nil {
+			if git, ok := git.(*GitSource); ok {
+				gitCaches[git.CacheKey()]++
+			}
+		}
+	}
+
+	stale, err = staleSources(&repo, reposrcdir, used)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	if prune && !plan && len(unreadable) > 0 && len(stale) > 0 {
+		log.Printf("Cannot read the description of %s, not deleting any sources", strings.Join(unreadable, ", "))
+		res += 1
+		prune = false
+	}
+	for _, name := range sortedKeys(stale) {
+		if !removedSet[name] {
+			removed = append(removed, name)
+		}
+		if !prune || plan {
+			log.Printf("Package %s is no longer in the repository, its sources are left: %s", name, strings.Join(stale[name], " "))
+			continue
+		}
+		log.Printf("Package %s is no longer in the repository, deleting its sources", name)
+		pruned[name] = true
+		for _, path := range stale[name] {
+			log.Printf("rm -rf %s", path)
+			err = os.RemoveAll(path)
+			if err != nil {
+				log.Println(err)
+				res += 1
+				pruned[name] = false
+			}
+		}
+	}
+
+	for _, item := range repo.Packages {
+		name := item.Name
 		srcdir := filepath.Join(reposrcdir, name)
 		pkgdir := filepath.Join(repopkgdir, name)
 		prevdir := ""
+		hasPrev := false
 		if repoprevdir != "" {
 			prevdir = filepath.Join(repoprevdir, name)
+			_, err := os.Stat(prevdir)
+			hasPrev = err == nil
+		}
+
+		log.Printf("Package %s", name)
+
+		// Packages not selected are kept as they were
+		if !sel.Selected(name) {
+			if !hasPrev {
+				log.Printf("Not selected, no previous build")
+				statuses[name] = "not selected, no previous build"
+				continue
+			}
+			statuses[name] = "not selected, unchanged"
+			if plan {
+				continue
+			}
+			log.Printf("Not selected, taking packages at %s", prevdir)
+			err := LinkRecursive(prevdir, pkgdir)
+			if err != nil {
+				log.Println(err)
+				res += 1
+				delete(statuses, name)
+			}
+			continue
 		}
 
-		err := os.MkdirAll(pkgdir, 0777)
+		if err := invalid[name]; err != nil {
+			log.Println(err)
+			res += 1
+			statuses[name] = "invalid description"
+			continue
+		}
+
+		desc, err := repo.packageDescription(item, repoyaml, reposrcdir)
 		if err != nil {
 			log.Println(err)
 			res += 1
 			continue
 		}
 
-		log.Printf("Package %s", name)
 		if item.Value != nil {
-			err = writeYAML(srcdir+".yaml", item.Value)
+			err = writeYAML(srcdir+".yaml", desc.Node)
 			if err != nil {
 				log.Println(err)
 				res += 1
@@ -176,15 +404,19 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 			}
 		}
 
-		var gitpkg GitPackage
-		err = readYAML(srcdir+".yaml", &gitpkg)
+		gitpkg, err := decodePackage(defaults, desc)
 		if err != nil {
 			log.Println(err)
 			res += 1
 			continue
 		}
 
-		yamlhash, _ := hashFile(srcdir + ".yaml")
+		err = writeFPMBuildConfig(srcdir+".fpmbuild.yaml", desc.Node)
+		if err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
 
 		err = os.MkdirAll(srcdir, 0777)
 		if err != nil {
@@ -193,130 +425,237 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 			continue
 		}
 
+		if gitpkg.Path != "" && !filepath.IsAbs(gitpkg.Path) {
+			gitpkg.Path = filepath.Join(filepath.Dir(repoyaml), gitpkg.Path)
+		}
+		if gitpkg.Verify != nil {
+			err = gitpkg.Verify.resolve(filepath.Dir(repoyaml))
+			if err != nil {
+				log.Println(err)
+				res += 1
+				continue
+			}
+		}
+		source, err := gitpkg.Source(srcdir)
+		if err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
+		if git, ok := source.(*GitSource); ok && gitCaches[git.CacheKey()] > 1 {
+			git.Cache = filepath.Join(reposrcdir, "_git", git.CacheKey())
+		}
+
+		pkgdirabs, err := filepath.Abs(pkgdir)
+		if err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
+
+		srcsubdir := srcdir
+		if gitpkg.Subdir != "" {
+			srcsubdir = filepath.Join(srcsubdir, gitpkg.Subdir)
+		}
+
+		backdir, err := filepath.Rel(srcsubdir, reposrcdir)
+		if err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
+
+		args := []string{
+			"-config", filepath.Join(backdir, defaultsFile),
+			"-config", filepath.Join(backdir, name+".fpmbuild.yaml"),
+			"-t", target,
+		}
+		if sudo {
+			args = append([]string{"-sudo"}, args...)
+		}
+
+		statefile := srcdir + ".state"
 		dirty := true
+		reason := "no source revision"
+		state := BuildState{}
+		cached := ""
 
-		if gitpkg.GitURL != "" {
+		if source != nil {
 
-			if _, e := os.Stat(filepath.Join(srcdir, ".git")); os.IsNotExist(e) {
-				log.Printf("git init %s", srcdir)
-				cmd := exec.Command("git", "init", srcdir)
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				err := cmd.Run()
+			err = source.Fetch()
+			if err != nil {
+				log.Println(err)
+				res += 1
+			}
+
+			// The signature of the fetched commit is verified before it is
+			// checked out
+			if git, ok := source.(*GitSource); ok && git.Verify != nil {
+				_, err = git.PlannedRevision()
 				if err != nil {
 					log.Println(err)
 					res += 1
 					continue
 				}
+				err = git.VerifySignature()
+				if err != nil {
+					log.Printf("Refusing to build %s: %v", name, err)
+					res += 1
+					statuses[name] = "signature verification failed"
+					if hasPrev && !plan {
+						log.Printf("Keeping the previous build at %s", prevdir)
+						err = LinkRecursive(prevdir, pkgdir)
+						if err != nil {
+							log.Println(err)
+						} else {
+							statuses[name] += ", previous build kept"
+						}
+					} else if hasPrev {
+						statuses[name] += ", previous build kept"
+					}
+					continue
+				}
 			}
 
-			log.Printf("git config remote.origin.url %s", gitpkg.GitURL)
-			cmd := exec.Command("git", "config", "remote.origin.url", gitpkg.GitURL)
-			cmd.Dir = srcdir
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				log.Println(err)
-				res += 1
-				continue
+			// The plan leaves the checkout as it is and reads the revision from
+			// the fetched source
+			if plan {
+				planned, ok := source.(PlannedSource)
+				if !ok {
+					statuses[name] = "rebuild: revision unknown without checkout"
+					continue
+				}
+				state.Revision, err = planned.PlannedRevision()
+			} else {
+				err = source.Checkout()
 			}
-
-			log.Printf("git -c core.bare=true fetch -f origin +refs/*:refs/* HEAD")
-			cmd = exec.Command("git", "-c", "core.bare=true", "fetch", "-f", "origin", "+refs/*:refs/*", "HEAD")
-			cmd.Dir = filepath.Join(srcdir, ".git")
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
 			if err != nil {
 				log.Println(err)
 				res += 1
+				continue
 			}
 
-			ref := "FETCH_HEAD"
-			if gitpkg.Ref != "" && gitpkg.Ref != "HEAD" {
-				ref = gitpkg.Ref
+			if !plan {
+				state.Revision, err = source.Revision()
+				if err != nil {
+					log.Println(err)
+					res += 1
+					continue
+				}
 			}
-			log.Printf("git reset --hard %s --", ref)
-			cmd = exec.Command("git", "reset", "--hard", ref, "--")
-			cmd.Dir = srcdir
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
+			state.Revision = strings.TrimSpace(state.Revision)
+
+			// The plan compares the configuration files, the build key
+			// may build or pull the docker images
+			state.ConfigHash, err = configHash(target,
+				filepath.Join(reposrcdir, defaultsFile),
+				srcdir+".fpmbuild.yaml",
+				filepath.Join(srcsubdir, ".fpmbuild.yaml"))
 			if err != nil {
 				log.Println(err)
 				res += 1
 				continue
 			}
 
-			log.Printf("git submodule update --init --force --checkout --recursive")
-			cmd = exec.Command("git", "submodule", "update", "--init", "--force", "--checkout", "--recursive")
-			cmd.Dir = srcdir
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				log.Println(err)
-				res += 1
-				continue
+			if !plan {
+				state.Config, err = fpmbuildKey(srcsubdir, args)
+				if err != nil {
+					log.Println(err)
+					log.Println("Building without the cache")
+				} else {
+					state.Key = state.buildKey(name)
+				}
 			}
 
-			revabs, err := GitRevParseHead(srcdir)
+			prev, err := readBuildState(srcdir + ".ok")
 			if err != nil {
 				log.Println(err)
 				res += 1
 				continue
 			}
 
-			revokfile, err := ioutil.ReadFile(srcdir + ".ok")
-			if err != nil && !os.IsNotExist(err) {
-				log.Println(err)
-				res += 1
-				continue
+			inStore := false
+			if state.Key != "" && !plan {
+				inStore, err = storeEntry(repostoredir, state.Key, statefile)
+				if err != nil {
+					log.Println(err)
+					res += 1
+					continue
+				}
 			}
-
-			if err == nil && string(revokfile) == revabs+"-"+yamlhash && prevdir != "" {
+			switch {
+			case sel.Force:
+				reason = "forced"
+			case plan && (prev.Key == "" || !hasPrev):
+				reason = "no previous build"
+			case plan && prev.Revision != state.Revision:
+				reason = "new revision " + state.Revision
+			case plan && prev.ConfigHash == "":
+				reason = "configuration of the previous build unknown"
+			case plan && prev.ConfigHash != state.ConfigHash:
+				reason = "configuration changed"
+			case plan:
+				dirty = false
+				reason = "same revision and configuration"
+			case inStore:
 				dirty = false
-				log.Printf("Package already at revision %s", revabs)
+				cached = filepath.Join(repostoredir, state.Key)
+				log.Printf("Package already built with key %s", state.Key)
+			case state.Key != "" && prev.Key == state.Key && hasPrev:
+				dirty = false
+				cached = prevdir
+				log.Printf("Package already at revision %s", state.Revision)
+			case state.Key == "":
+				reason = "no build key"
+			case prev.Key == "" || !hasPrev:
+				reason = "no previous build"
+			case prev.Revision != state.Revision && prev.Config != state.Config:
+				reason = "new revision " + state.Revision + ", configuration changed"
+			case prev.Revision != state.Revision:
+				reason = "new revision " + state.Revision
+			case prev.Config != state.Config:
+				reason = "configuration changed"
+			default:
+				reason = "previous build missing"
+			}
+			if !dirty && !plan && prev.Key == state.Key {
+				reason = "unchanged"
+			} else if !dirty && !plan {
+				reason = "reused from the build cache"
 			}
 		}
 
-		if !dirty {
-
-			log.Printf("Not rebuilding, taking packages at %s", prevdir)
-
-			err := LinkRecursive(prevdir, pkgdir)
-			if err != nil {
-				log.Println(err)
-				res += 1
-				continue
+		if plan {
+			if dirty {
+				statuses[name] = "rebuild: " + reason
+			} else {
+				statuses[name] = "reuse: " + reason
 			}
+			continue
+		}
 
-		} else {
+		err = os.MkdirAll(pkgdir, 0777)
+		if err != nil {
+			log.Println(err)
+			res += 1
+			continue
+		}
 
-			pkgdirabs, err := filepath.Abs(pkgdir)
-			if err != nil {
-				log.Println(err)
-				res += 1
-				continue
-			}
+		if !dirty {
 
-			srcsubdir := srcdir
-			if gitpkg.Subdir != "" {
-				srcsubdir = filepath.Join(srcsubdir, gitpkg.Subdir)
-			}
+			log.Printf("Not rebuilding, taking packages at %s", cached)
 
-			backdir, err := filepath.Rel(srcsubdir, reposrcdir)
+			err := LinkRecursive(cached, pkgdir)
 			if err != nil {
 				log.Println(err)
 				res += 1
 				continue
 			}
 
-			args := []string{"-config", filepath.Join(backdir, name+".yaml"), "-f", "-o", pkgdirabs, "-t", target}
-			if sudo {
-				args = append([]string{"-sudo"}, args...)
-			}
+		} else {
+
+			log.Printf("Rebuilding: %s", reason)
+			args := append(args, "-state", filepath.Join(backdir, name+".state"), "-f", "-o", pkgdirabs)
 			log.Printf("fpmbuild %s", strings.Join(args, " "))
 			cmd := exec.Command("fpmbuild", args...)
 			cmd.Dir = srcsubdir
@@ -325,32 +664,65 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 			err = cmd.Run()
 			if err != nil {
 				log.Println(err)
+				statuses[name] = buildFailure(err)
 				res += 1
 				continue
 			}
 
 		}
 
-		if gitpkg.GitURL != "" {
-
-			revabs, err := GitRevParseHead(srcdir)
+		if state.Key != "" {
+			// A forced build, or a build of a newer iteration, replaces
+			// the stored packages
+			if dirty {
+				os.RemoveAll(filepath.Join(repostoredir, state.Key))
+				os.Remove(filepath.Join(repostoredir, state.Key+".state"))
+			}
+			err = storeBuild(repostoredir, state.Key, pkgdir, statefile)
 			if err != nil {
 				log.Println(err)
-				res += 1
-				continue
 			}
+		}
 
-			err = ioutil.WriteFile(srcdir+".ok", []byte(revabs+"-"+yamlhash), 0666)
+		if source != nil {
+
+			err = writeBuildState(srcdir+".ok", state)
 			if err != nil {
 				log.Println(err)
 				res += 1
 				continue
 			}
 
-			log.Printf("Build successful at revision %s", revabs)
+			log.Printf("Build successful at revision %s", state.Revision)
 		} else {
 			log.Printf("Build successful")
 		}
+
+		if dirty {
+			statuses[name] = "built: " + reason
+		} else {
+			statuses[name] = reason
+		}
+	}
+
+	if plan {
+		return res
+	}
+
+	// The checkouts of the packages no longer sharing a git cache have
+	// copied its objects when fetching
+	caches, err := unusedGitCaches(reposrcdir, gitCaches)
+	if err != nil {
+		log.Println(err)
+		res += 1
+	}
+	for _, cache := range caches {
+		log.Printf("Git cache %s is no longer used, deleting it", cache)
+		err = os.RemoveAll(cache)
+		if err != nil {
+			log.Println(err)
+			res += 1
+		}
 	}
 
 	log.Println("Package build successful, generating metadata")
@@ -403,6 +775,42 @@ func run(repofname string, target string, sudo bool, datadir string) (res int) {
 	return 0
 }
 
+// removedPackages returns the packages of the previous build that are not in
+// the repository any more. Packages are the directories of the build.
+func removedPackages(repo *Repository, repoprevdir string) ([]string, error) {
+	if repoprevdir == "" {
+		return nil, nil
+	}
+	known := map[string]bool{}
+	for _, item := range repo.Packages {
+		known[item.Name] = true
+	}
+	entries, err := ioutil.ReadDir(repoprevdir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, entry := range entries {
+		if entry.IsDir() && !known[entry.Name()] {
+			removed = append(removed, entry.Name())
+		}
+	}
+	return removed, nil
+}
+
+// buildFailure tells from the fpmbuild exit status why the build failed
+func buildFailure(err error) string {
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		switch exiterr.ExitCode() {
+		case 124:
+			return "timed out"
+		case 137:
+			return "out of memory"
+		}
+	}
+	return "failed"
+}
+
 func GitRevParseHead(dir string) (string, error) {
 	var revabs bytes.Buffer
 	cmd := exec.Command("git", "rev-parse", "HEAD")
@@ -0,0 +1,109 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sourceSuffixes are the suffixes of the files kept in the source directory of
+// the repository for each package, longest first
+var sourceSuffixes = []string{".fpmbuild.yaml", ".archive", ".state", ".yaml", ".tmp", ".ok"}
+
+// staleSources returns by package name the entries of the source directory
+// belonging to packages no longer in the repository. Entries starting with _
+// (the repository file, the git caches) and the paths in keep (local sources
+// or keys in the source directory) and the directories containing them are
+// never stale.
+func staleSources(repo *Repository, reposrcdir string, keep []string) (map[string][]string, error) {
+	known := map[string]bool{}
+	for _, item := range repo.Packages {
+		known[item.Name] = true
+	}
+	reposrcdir, err := filepath.Abs(reposrcdir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(reposrcdir)
+	if err != nil {
+		return nil, err
+	}
+	stale := map[string][]string{}
+	for _, entry := range entries {
+		path := filepath.Join(reposrcdir, entry.Name())
+		if strings.HasPrefix(entry.Name(), "_") || contains(path, keep) {
+			continue
+		}
+		name := ""
+		for _, suffix := range sourceSuffixes {
+			if strings.HasSuffix(entry.Name(), suffix) {
+				name = strings.TrimSuffix(entry.Name(), suffix)
+				break
+			}
+		}
+		if name == "" && entry.IsDir() {
+			name = entry.Name()
+		}
+		if name != "" && !known[name] {
+			stale[name] = append(stale[name], path)
+		}
+	}
+	return stale, nil
+}
+
+// unusedGitCaches returns the git caches of the source directory, _git/<key>,
+// that are neither shared by the packages (used counts the packages of each
+// key) nor borrowed from by a checkout
+func unusedGitCaches(reposrcdir string, used map[string]int) ([]string, error) {
+	caches, err := filepath.Glob(filepath.Join(reposrcdir, "_git", "*"))
+	if err != nil {
+		return nil, err
+	}
+	alternates, err := filepath.Glob(filepath.Join(reposrcdir, "*", ".git", "objects", "info", "alternates"))
+	if err != nil {
+		return nil, err
+	}
+	borrowed := map[string]bool{}
+	for _, file := range alternates {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, objects := range strings.Fields(string(data)) {
+			borrowed[filepath.Dir(objects)] = true
+		}
+	}
+	var unused []string
+	for _, cache := range caches {
+		abs, err := filepath.Abs(cache)
+		if err != nil {
+			return nil, err
+		}
+		if used[filepath.Base(cache)] < 2 && !borrowed[abs] {
+			unused = append(unused, cache)
+		}
+	}
+	return unused, nil
+}
+
+// contains tells if one of the paths is dir or is inside dir
+func contains(dir string, paths []string) bool {
+	for _, path := range paths {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys(m map[string][]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
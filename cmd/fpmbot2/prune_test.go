@@ -0,0 +1,75 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStaleSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fpmbot2-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := Repository{Packages: PackageList{{Name: "a"}, {Name: "b.c"}}}
+	tests := []struct {
+		entry string
+		dir   bool
+		stale string // Package the entry belongs to if stale
+	}{
+		{"a", true, ""},
+		{"a.yaml", false, ""},
+		{"a.fpmbuild.yaml", false, ""},
+		{"a.ok", false, ""},
+		{"b.c", true, ""},
+		{"b.c.state", false, ""},
+		{"gone", true, "gone"},
+		{"gone.fpmbuild.yaml", false, "gone"},
+		{"gone.yaml", false, "gone"},
+		{"gone.archive", false, "gone"},
+		{"gone.state", false, "gone"},
+		{"gone.tmp", true, "gone"},
+		{"gone.ok", false, "gone"},
+		{"a.fpmbuild", true, "a.fpmbuild"},
+		{"_git", true, ""},
+		{"_gone.yaml", false, ""},
+		{"keys", true, ""},
+		{"local.yaml", false, ""},
+		{"README", false, ""},
+		{"notes.txt", false, ""},
+	}
+	want := map[string][]string{}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.entry)
+		if test.dir {
+			err = os.Mkdir(path, 0777)
+		} else {
+			err = ioutil.WriteFile(path, nil, 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.stale != "" {
+			want[test.stale] = append(want[test.stale], path)
+		}
+	}
+	keep := []string{filepath.Join(dir, "keys", "key.gpg"), filepath.Join(dir, "local.yaml")}
+
+	got, err := staleSources(&repo, dir, keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range want {
+		// Entries are listed in order
+		sort.Strings(want[name])
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
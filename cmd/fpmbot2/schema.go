@@ -0,0 +1,79 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"reflect"
+
+	"internal/fpmconfig"
+)
+
+// Schema returns the JSON Schema of the repository files
+func Schema() ([]byte, error) {
+	pkg, err := packageSchema()
+	if err != nil {
+		return nil, err
+	}
+	delete(pkg, "$schema")
+	delete(pkg, "title")
+	// A package without description uses the existing <name>.yaml file
+	pkg["type"] = []string{"object", "null"}
+	// The defaults are a package description
+	defaults := map[string]interface{}{}
+	for key, value := range pkg {
+		defaults[key] = value
+	}
+	defaults["type"] = "object"
+
+	t := reflect.TypeOf(Repository{})
+	target, _ := t.FieldByName("Target")
+	defaultsField, _ := t.FieldByName("Defaults")
+	packages, _ := t.FieldByName("Packages")
+	defaults["description"] = defaultsField.Tag.Get("doc")
+	repo := map[string]interface{}{
+		"$schema": fpmconfig.SchemaURL,
+		"title":   "fpmbot2 repository (_repo.yaml)",
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"target": map[string]interface{}{
+				"type":        "string",
+				"description": target.Tag.Get("doc"),
+			},
+			"defaults": defaults,
+			"packages": map[string]interface{}{
+				"type":                 "object",
+				"description":          packages.Tag.Get("doc"),
+				"additionalProperties": pkg,
+			},
+		},
+		"additionalProperties": false,
+	}
+	return json.MarshalIndent(repo, "", "  ")
+}
+
+// packageSchema returns the schema of a package description: the schema of
+// fpmbuild -schema extended with the GitPackage keys
+func packageSchema() (map[string]interface{}, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("fpmbuild", "-schema")
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+	var pkg map[string]interface{}
+	err = json.Unmarshal(out.Bytes(), &pkg)
+	if err != nil {
+		return nil, err
+	}
+	properties := pkg["properties"].(map[string]interface{})
+	gitpkg := fpmconfig.TypeSchema(reflect.TypeOf(GitPackage{}), reflect.Value{})
+	for name, prop := range gitpkg["properties"].(map[string]interface{}) {
+		properties[name] = prop
+	}
+	return pkg, nil
+}
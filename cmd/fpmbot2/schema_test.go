@@ -0,0 +1,39 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestSchemaFile fails when fpmbot2.schema.json is not the output of
+// fpmbot2 -schema, run make schema to update it. The package schema comes from
+// fpmbuild, built from the sources next to fpmbot2.
+func TestSchemaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fpmbot2-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out, err := exec.Command("go", "build", "-o", filepath.Join(dir, "fpmbuild"), "../fpmbuild").CombinedOutput()
+	if err != nil {
+		t.Fatalf("go build fpmbuild: %v\n%s", err, out)
+	}
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.ReadFile("../../fpmbot2.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(schema, '\n'), file) {
+		t.Error("fpmbot2.schema.json is out of date, run make schema")
+	}
+}
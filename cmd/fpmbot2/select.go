@@ -0,0 +1,59 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// namesFlag is a command line flag taking comma separated package names, it
+// can be repeated
+type namesFlag map[string]bool
+
+func (f namesFlag) String() string {
+	var names []string
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f namesFlag) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			f[name] = true
+		}
+	}
+	return nil
+}
+
+// Selection tells which packages of a repository to build
+type Selection struct {
+	Only  namesFlag // Build only these packages, all if empty
+	Skip  namesFlag // Do not build these packages
+	Force bool      // Rebuild the selected packages even if unchanged
+}
+
+// Selected tells if the package should be built
+func (s *Selection) Selected(name string) bool {
+	return (len(s.Only) == 0 || s.Only[name]) && !s.Skip[name]
+}
+
+// check returns an error if a selected or skipped package is not in the
+// repository
+func (s *Selection) check(repo *Repository) error {
+	known := map[string]bool{}
+	for _, item := range repo.Packages {
+		known[item.Name] = true
+	}
+	for _, names := range []namesFlag{s.Only, s.Skip} {
+		for name := range names {
+			if !known[name] {
+				return fmt.Errorf("no package %s in the repository", name)
+			}
+		}
+	}
+	return nil
+}
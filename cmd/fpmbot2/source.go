@@ -0,0 +1,691 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Source brings the package source to the source directory
+type Source interface {
+	// Fetch downloads the source. On failure, the source previously fetched
+	// can still be checked out.
+	Fetch() error
+	// Checkout updates the source directory to the fetched source
+	Checkout() error
+	// Revision identifies the checked out source, builds are skipped when it
+	// did not change
+	Revision() (string, error)
+}
+
+// A PlannedSource tells the revision Checkout would give from the fetched
+// source, without changing the source directory (for fpmbot2 -plan)
+type PlannedSource interface {
+	PlannedRevision() (string, error)
+}
+
+// Source returns the source of the package in srcdir, nil if the package has
+// no source
+func (p *GitPackage) Source(srcdir string) (Source, error) {
+	var sources []Source
+	switch p.Track {
+	case "", "ref":
+	case "tags":
+		if p.GitURL == "" {
+			return nil, fmt.Errorf("track: tags is only supported for git")
+		} else if p.Ref != "" {
+			return nil, fmt.Errorf("ref cannot be used with track: tags")
+		}
+	default:
+		return nil, fmt.Errorf("unknown track %s, expected ref or tags", p.Track)
+	}
+	if p.Verify != nil && p.GitURL == "" {
+		return nil, fmt.Errorf("verify is only supported for git")
+	}
+	if p.GitURL != "" {
+		sources = append(sources, &GitSource{
+			Dir:        srcdir,
+			URL:        p.GitURL,
+			Ref:        p.Ref,
+			TrackTags:  p.Track == "tags",
+			TagPattern: p.TagPattern,
+			TagRegexp:  p.TagRegexp,
+			Depth:      p.Depth,
+			SingleRef:  p.SingleRef,
+			Filter:     p.Filter,
+			Subdir:     p.Subdir,
+			Watch:      p.Watch,
+			Verify:     p.Verify,
+		})
+	}
+	if p.HgURL != "" {
+		sources = append(sources, &HgSource{Dir: srcdir, URL: p.HgURL, Ref: p.Ref})
+	}
+	if p.SvnURL != "" {
+		sources = append(sources, &SvnSource{Dir: srcdir, URL: p.SvnURL, Ref: p.Ref})
+	}
+	if p.Tarball != "" {
+		if p.SHA256 == "" {
+			return nil, fmt.Errorf("tarball %s: sha256 is required", p.Tarball)
+		}
+		sources = append(sources, &TarballSource{Dir: srcdir, URL: p.Tarball, SHA256: p.SHA256})
+	} else if p.SHA256 != "" {
+		return nil, fmt.Errorf("sha256 without tarball")
+	}
+	if p.Path != "" {
+		sources = append(sources, &PathSource{Dir: srcdir, Path: p.Path})
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("only one of git, hg, svn, tarball or path can be specified")
+	} else if len(sources) == 0 {
+		return nil, nil
+	}
+	return sources[0], nil
+}
+
+// command runs a command in dir, logging it
+func command(dir string, name string, args ...string) error {
+	log.Printf("%s %s", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// commandOutput runs a command in dir and returns its output
+func commandOutput(dir string, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	return strings.TrimSpace(out.String()), err
+}
+
+type GitSource struct {
+	Dir string
+	URL string
+	Ref string
+	// Build the newest tag matching TagPattern and TagRegexp instead of Ref
+	TrackTags  bool
+	TagPattern string
+	TagRegexp  string
+	// Fetch only the last Depth commits if not zero
+	Depth int
+	// Fetch only Ref (or the tags when tracking tags) instead of all the refs
+	SingleRef bool
+	// Partial clone filter (git fetch --filter)
+	Filter string
+	// Bare repository fetching the objects on behalf of the source, shared
+	// with the other sources with the same URL. Empty for no cache.
+	Cache string
+	// When Subdir is set, the revision is made of the trees of Subdir and the
+	// Watch paths instead of the commit, so changes elsewhere in the
+	// repository do not trigger a build.
+	Subdir string
+	Watch  []string
+	// Keys allowed to sign the commit or the tag. Nil to skip verification.
+	Verify *VerifyOptions
+
+	tag    string
+	commit string // Planned commit, checked out and verified instead of the ref
+}
+
+func (s *GitSource) Fetch() error {
+	gitdir := filepath.Join(s.Dir, ".git")
+	if _, e := os.Stat(gitdir); os.IsNotExist(e) {
+		err := command("", "git", "init", s.Dir)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.configure(gitdir)
+	if err != nil {
+		return err
+	}
+
+	if s.Cache != "" {
+		if _, e := os.Stat(s.Cache); os.IsNotExist(e) {
+			err := command("", "git", "init", "--bare", s.Cache)
+			if err != nil {
+				return err
+			}
+		}
+		err := s.configure(s.Cache)
+		if err != nil {
+			return err
+		}
+		// The cache is shared by sources fetching the same refs
+		err = command(s.Cache, "git", s.fetchArgs(s.refspecs()...)...)
+		if err != nil {
+			return err
+		}
+		// Objects already in the cache are not fetched again
+		objects, err := filepath.Abs(filepath.Join(s.Cache, "objects"))
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(gitdir, "objects", "info", "alternates"), []byte(objects+"\n"), 0666)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := unshare(gitdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return command(gitdir, "git", append([]string{"-c", "core.bare=true"}, s.fetchArgs(s.refspecs()...)...)...)
+}
+
+// unshare copies in the repository the objects it borrows from a cache it no
+// longer uses, so the cache can be removed
+func unshare(gitdir string) error {
+	alternates := filepath.Join(gitdir, "objects", "info", "alternates")
+	if _, err := os.Stat(alternates); os.IsNotExist(err) {
+		return nil
+	}
+	err := command(gitdir, "git", "repack", "-a", "-d")
+	if err != nil {
+		return err
+	}
+	return os.Remove(alternates)
+}
+
+// refspecs returns the refs to fetch: all of them unless SingleRef is set
+func (s *GitSource) refspecs() []string {
+	if s.SingleRef && s.TrackTags {
+		return []string{"+refs/tags/*:refs/tags/*"}
+	} else if s.SingleRef && s.Ref != "" {
+		return []string{s.Ref}
+	} else if s.SingleRef {
+		return []string{"HEAD"}
+	}
+	return []string{"+refs/*:refs/*", "HEAD"}
+}
+
+// CacheKey identifies the sources that can share a cache: the sources with
+// the same URL, depth, filter and fetched refs
+func (s *GitSource) CacheKey() string {
+	key := fmt.Sprintf("%s\n%d\n%s\n%s", s.URL, s.Depth, s.Filter, strings.Join(s.refspecs(), " "))
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// configure sets the remote of a repository
+func (s *GitSource) configure(gitdir string) error {
+	err := command(gitdir, "git", "config", "remote.origin.url", s.URL)
+	if err != nil || s.Filter == "" {
+		return err
+	}
+	err = command(gitdir, "git", "config", "remote.origin.promisor", "true")
+	if err != nil {
+		return err
+	}
+	return command(gitdir, "git", "config", "remote.origin.partialclonefilter", s.Filter)
+}
+
+// fetchArgs returns the git fetch arguments for the refspecs
+func (s *GitSource) fetchArgs(refspecs ...string) []string {
+	args := []string{"fetch", "-f"}
+	if s.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(s.Depth))
+	}
+	if s.Filter != "" {
+		args = append(args, "--filter", s.Filter)
+	}
+	return append(append(args, "origin"), refspecs...)
+}
+
+// checkoutRef returns the fetched ref to check out, the latest tag when
+// tracking tags
+func (s *GitSource) checkoutRef() (string, error) {
+	if s.TrackTags {
+		out, err := commandOutput(s.Dir, "git", "tag", "-l")
+		if err != nil {
+			return "", err
+		}
+		s.tag, err = latestTag(strings.Fields(out), s.TagPattern, s.TagRegexp)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("Latest tag %s", s.tag)
+		return "refs/tags/" + s.tag, nil
+	} else if s.Ref != "" && s.Ref != "HEAD" && !s.SingleRef {
+		return s.Ref, nil
+	}
+	return "FETCH_HEAD", nil
+}
+
+// Checkout checks out the planned commit, if PlannedRevision was called, or
+// the ref
+func (s *GitSource) Checkout() error {
+	ref := s.commit
+	if ref == "" {
+		var err error
+		ref, err = s.checkoutRef()
+		if err != nil {
+			return err
+		}
+	}
+	err := command(s.Dir, "git", "reset", "--hard", ref, "--")
+	if err != nil {
+		return err
+	}
+	return command(s.Dir, "git", "submodule", "update", "--init", "--force", "--checkout", "--recursive")
+}
+
+// Revision is the commit id, or the tree ids of the package directory and the
+// watched paths, preceded by the tag when tracking tags
+func (s *GitSource) Revision() (string, error) {
+	var rev string
+	var err error
+	if s.Subdir != "" {
+		rev, err = s.treeRevision("HEAD")
+	} else {
+		rev, err = GitRevParseHead(s.Dir)
+	}
+	if s.tag != "" {
+		rev = s.tag + " " + rev
+	}
+	return rev, err
+}
+
+// PlannedRevision is the revision of the ref Checkout would check out
+func (s *GitSource) PlannedRevision() (string, error) {
+	ref, err := s.checkoutRef()
+	if err != nil {
+		return "", err
+	}
+	s.commit, err = commandOutput(s.Dir, "git", "rev-parse", "--verify", "-q", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s: no fetched commit %s", s.URL, ref)
+	}
+	rev := s.commit
+	if s.Subdir != "" {
+		rev, err = s.treeRevision(s.commit)
+	}
+	if s.tag != "" {
+		rev = s.tag + " " + rev
+	}
+	return rev, err
+}
+
+// treeRevision returns the ids of the trees of Subdir and the watched paths in
+// commit
+func (s *GitSource) treeRevision(commit string) (string, error) {
+	var ids []string
+	for _, p := range append([]string{s.Subdir}, s.Watch...) {
+		p = path.Clean(p)
+		id, err := commandOutput(s.Dir, "git", "rev-parse", "--verify", "-q", commit+":"+p)
+		if err != nil {
+			// Missing paths are part of the revision too
+			id = "none"
+		}
+		ids = append(ids, p+":"+id)
+	}
+	return strings.Join(ids, " "), nil
+}
+
+type HgSource struct {
+	Dir string
+	URL string
+	Ref string
+}
+
+func (s *HgSource) Fetch() error {
+	if _, e := os.Stat(filepath.Join(s.Dir, ".hg")); os.IsNotExist(e) {
+		err := command("", "hg", "init", s.Dir)
+		if err != nil {
+			return err
+		}
+	}
+	return command(s.Dir, "hg", "pull", s.URL)
+}
+
+func (s *HgSource) Checkout() error {
+	ref := s.Ref
+	if ref == "" {
+		ref = "default"
+	}
+	err := command(s.Dir, "hg", "update", "--clean", "-r", ref)
+	if err != nil {
+		return err
+	}
+	return command(s.Dir, "hg", "--config", "extensions.purge=", "purge", "--all")
+}
+
+func (s *HgSource) Revision() (string, error) {
+	return commandOutput(s.Dir, "hg", "log", "-r", ".", "--template", "{node}")
+}
+
+func (s *HgSource) PlannedRevision() (string, error) {
+	ref := s.Ref
+	if ref == "" {
+		ref = "default"
+	}
+	return commandOutput(s.Dir, "hg", "log", "-r", ref, "--template", "{node}")
+}
+
+// SvnSource is a Subversion working copy. Subversion cannot fetch without
+// updating the working copy, so everything is done by Checkout.
+type SvnSource struct {
+	Dir string
+	URL string
+	Ref string
+}
+
+func (s *SvnSource) Fetch() error {
+	return nil
+}
+
+func (s *SvnSource) Checkout() error {
+	ref := s.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if _, e := os.Stat(filepath.Join(s.Dir, ".svn")); os.IsNotExist(e) {
+		return command("", "svn", "checkout", "--non-interactive", "-r", ref, s.URL, s.Dir)
+	}
+	err := command(s.Dir, "svn", "revert", "--non-interactive", "-R", ".")
+	if err != nil {
+		return err
+	}
+	return command(s.Dir, "svn", "switch", "--non-interactive", "--ignore-ancestry", "-r", ref, s.URL, ".")
+}
+
+func (s *SvnSource) Revision() (string, error) {
+	url, err := commandOutput(s.Dir, "svn", "info", "--show-item", "url")
+	if err != nil {
+		return "", err
+	}
+	rev, err := commandOutput(s.Dir, "svn", "info", "--show-item", "revision")
+	return url + "@" + rev, err
+}
+
+// TarballSource is an archive (tar or zip) downloaded from an URL and checked
+// against its SHA-256 sum. The archive is kept next to the source directory.
+// If all the files of the archive are in a single directory, that directory
+// is the source directory.
+type TarballSource struct {
+	Dir    string
+	URL    string
+	SHA256 string
+}
+
+// httpClient downloads the archives, a stalled server must not block the
+// other packages
+var httpClient = &http.Client{Timeout: 15 * time.Minute}
+
+func (s *TarballSource) archive() string {
+	return s.Dir + ".archive"
+}
+
+func (s *TarballSource) Fetch() error {
+	if sum, err := hashFileSHA256(s.archive()); err == nil && sum == s.SHA256 {
+		return nil
+	}
+	log.Printf("Downloading %s", s.URL)
+	resp, err := httpClient.Get(s.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", s.URL, resp.Status)
+	}
+	f, err := os.Create(s.archive() + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != s.SHA256 {
+		return fmt.Errorf("%s: sha256 mismatch, expected %s, got %s", s.URL, s.SHA256, sum)
+	}
+	return os.Rename(f.Name(), s.archive())
+}
+
+func (s *TarballSource) Checkout() error {
+	sum, err := hashFileSHA256(s.archive())
+	if err != nil {
+		return err
+	} else if sum != s.SHA256 {
+		return fmt.Errorf("%s: sha256 mismatch, expected %s, got %s", s.archive(), s.SHA256, sum)
+	}
+
+	tmpdir := s.Dir + ".tmp"
+	err = os.RemoveAll(tmpdir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(tmpdir, 0777)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	archive, err := filepath.Abs(s.archive())
+	if err != nil {
+		return err
+	}
+	if isZip(archive) {
+		err = command(tmpdir, "unzip", "-q", archive)
+	} else {
+		err = command(tmpdir, "tar", "-xf", archive)
+	}
+	if err != nil {
+		return err
+	}
+
+	root := tmpdir
+	names, err := readDirNames(tmpdir)
+	if err != nil {
+		return err
+	}
+	if len(names) == 1 {
+		if st, err := os.Lstat(filepath.Join(tmpdir, names[0])); err == nil && st.IsDir() {
+			root = filepath.Join(tmpdir, names[0])
+		}
+	}
+	err = os.RemoveAll(s.Dir)
+	if err != nil {
+		return err
+	}
+	return os.Rename(root, s.Dir)
+}
+
+func (s *TarballSource) Revision() (string, error) {
+	return "sha256:" + s.SHA256, nil
+}
+
+func (s *TarballSource) PlannedRevision() (string, error) {
+	return s.Revision()
+}
+
+// isZip tells if the file is a zip archive from its magic number
+func isZip(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == "PK\x03\x04"
+}
+
+func hashFileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// PathSource is a local directory, copied to the source directory so the build
+// does not modify it. Its revision is a hash of its content. The version
+// control directories are neither copied nor hashed.
+type PathSource struct {
+	Dir  string
+	Path string
+}
+
+func (s *PathSource) Fetch() error {
+	return nil
+}
+
+func (s *PathSource) Checkout() error {
+	log.Printf("Copying %s", s.Path)
+	err := os.RemoveAll(s.Dir)
+	if err != nil {
+		return err
+	}
+	return copyTree(s.Path, s.Dir)
+}
+
+func (s *PathSource) Revision() (string, error) {
+	h := sha256.New()
+	err := hashTree(h, s.Path, "")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+func (s *PathSource) PlannedRevision() (string, error) {
+	return s.Revision()
+}
+
+// vcsDirs are the version control directories skipped in local sources
+var vcsDirs = map[string]bool{".git": true, ".hg": true, ".svn": true}
+
+// hashTree writes the names, modes and contents of the files under dir to h,
+// in a stable order
+func hashTree(h io.Writer, dir, rel string) error {
+	path := filepath.Join(dir, rel)
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%s\x00%o\x00", rel, st.Mode())
+	switch {
+	case st.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00", target)
+	case st.IsDir():
+		names, err := readDirNames(path)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if vcsDirs[n] {
+				continue
+			}
+			err := hashTree(h, dir, filepath.Join(rel, n))
+			if err != nil {
+				return err
+			}
+		}
+	case st.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%d\x00", st.Size())
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the files, directories and symbolic links under from to to
+func copyTree(from, to string) error {
+	st, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	case st.IsDir():
+		err := os.MkdirAll(to, st.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		names, err := readDirNames(from)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if vcsDirs[n] {
+				continue
+			}
+			err := copyTree(filepath.Join(from, n), filepath.Join(to, n))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case st.Mode().IsRegular():
+		data, err := ioutil.ReadFile(from)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(to, data, st.Mode().Perm())
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the directory entries
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
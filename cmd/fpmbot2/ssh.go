@@ -0,0 +1,19 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sshCommand returns the ssh command for GIT_SSH_COMMAND that only accepts
+// hosts listed in the knownHosts file, like fpmbuild does in the builds
+func sshCommand(knownHosts string) string {
+	return fmt.Sprintf("ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", shellEscape(knownHosts))
+}
+
+// shellEscape quotes s for sh, git runs GIT_SSH_COMMAND with the shell
+func shellEscape(s string) string {
+	s = strings.Replace(s, `'`, `'"'"'`, -1)
+	return `'` + s + `'`
+}
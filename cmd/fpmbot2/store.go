@@ -0,0 +1,170 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fpmbuildKey returns the fpmbuild build key of the package, covering the
+// configuration, the target, the docker images and the fpmbuild version
+func fpmbuildKey(dir string, args []string) (string, error) {
+	args = append([]string{"-build-key"}, args...)
+	log.Printf("fpmbuild %s", strings.Join(args, " "))
+	var out bytes.Buffer
+	cmd := exec.Command("fpmbuild", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("fpmbuild -build-key: %v", err)
+	}
+	key := strings.TrimSpace(out.String())
+	if key == "" {
+		return "", fmt.Errorf("fpmbuild -build-key: no key")
+	}
+	return key, nil
+}
+
+// sysConfigDir is the directory of the system configuration of fpmbuild
+const sysConfigDir = "/etc/fpmbuild.d"
+
+// configHash returns a hash of the target and of the configuration files
+// fpmbuild reads, its system configuration included. Unlike the build key it
+// does not need docker, images are only known by their reference. Missing
+// files are skipped.
+func configHash(target string, files ...string) (string, error) {
+	sysfiles, err := filepath.Glob(filepath.Join(sysConfigDir, "*.yaml"))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "target %s\n", target)
+	for _, file := range append(sysfiles, files...) {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "file %s %d\n", file, len(data))
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// BuildState is the state of the last successful build of a package, kept in
+// the <name>.ok file
+type BuildState struct {
+	Key        string // Key of the build, see buildKey
+	Revision   string // Source revision
+	Config     string // fpmbuild build key
+	ConfigHash string // Hash of the configuration files, see configHash
+}
+
+// buildKey returns the key of a package build: a hash of the package name,
+// the source revision and the fpmbuild build key. Builds with the same key
+// produce the same packages.
+func (s *BuildState) buildKey(name string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "package %s\nrevision %s\nfpmbuild %s\n", name, s.Revision, s.Config)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// readBuildState reads a <name>.ok file, a missing file gives an empty state
+func readBuildState(file string) (state BuildState, err error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, err
+	}
+	lines := append(strings.Split(string(data), "\n"), "", "", "", "")
+	state.Key, state.Revision, state.Config, state.ConfigHash = lines[0], lines[1], lines[2], lines[3]
+	return state, nil
+}
+
+func writeBuildState(file string, state BuildState) error {
+	data := state.Key + "\n" + state.Revision + "\n" + state.Config + "\n" + state.ConfigHash + "\n"
+	return ioutil.WriteFile(file, []byte(data), 0666)
+}
+
+// IterationState is the fpmbuild state of a package (-state): the version of
+// the last build and the number of builds of this version, its iteration
+type IterationState struct {
+	Version   string `yaml:"version"`
+	Iteration int    `yaml:"iteration"`
+}
+
+// storeEntry tells if the packages stored under key can be reused. The
+// iteration of the stored packages must not be older than the last build of
+// the same version, in statefile, or the published packages would go back to
+// an older version. When the stored iteration is newer, statefile is updated
+// so the next build is numbered after it.
+func storeEntry(store, key, statefile string) (bool, error) {
+	dest := filepath.Join(store, key)
+	if _, err := os.Stat(dest); err != nil {
+		return false, nil
+	}
+	var stored, last IterationState
+	err := readYAML(dest+".state", &stored)
+	if os.IsNotExist(err) {
+		// Stored before the iterations were recorded
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	err = readYAML(statefile, &last)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if stored.Version != last.Version || stored.Iteration == last.Iteration {
+		return true, nil
+	} else if stored.Iteration < last.Iteration {
+		log.Printf("Build cache %s has iteration %d of version %s, the last build has %d", key, stored.Iteration, stored.Version, last.Iteration)
+		return false, nil
+	}
+	return true, writeYAML(statefile, &stored)
+}
+
+// storeBuild hard links the packages of pkgdir in the store under key, unless
+// they are already there. The fpmbuild state of the build, statefile, is kept
+// next to them.
+func storeBuild(store, key, pkgdir, statefile string) error {
+	dest := filepath.Join(store, key)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(store, 0777)
+	if err != nil {
+		return err
+	}
+	var state IterationState
+	err = readYAML(statefile, &state)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = writeYAML(dest+".state", &state)
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = LinkRecursive(pkgdir, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
@@ -0,0 +1,118 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var tagPrefix = regexp.MustCompile(`^[^0-9]*`)
+
+// latestTag returns the newest tag matching the glob pattern and the regexp
+// (when not empty). Tags are compared as versions, tags without version
+// number are ignored.
+func latestTag(tags []string, pattern, re string) (string, error) {
+	var rx *regexp.Regexp
+	if re != "" {
+		var err error
+		rx, err = regexp.Compile(re)
+		if err != nil {
+			return "", err
+		}
+	}
+	var matching []string
+	for _, tag := range tags {
+		if pattern != "" {
+			if ok, err := path.Match(pattern, tag); err != nil {
+				return "", err
+			} else if !ok {
+				continue
+			}
+		}
+		if rx != nil && !rx.MatchString(tag) {
+			continue
+		}
+		if tagPrefix.ReplaceAllString(tag, "") == "" {
+			continue
+		}
+		matching = append(matching, tag)
+	}
+	if len(matching) == 0 {
+		return "", fmt.Errorf("no tag matching %s", strings.TrimSpace(pattern+" "+re))
+	}
+	sort.SliceStable(matching, func(i, j int) bool {
+		return compareVersions(matching[i], matching[j]) < 0
+	})
+	return matching[len(matching)-1], nil
+}
+
+// compareVersions compares two version tags in the semantic versioning order,
+// ignoring the non numeric prefix: v1.10.0 > v1.9.2 > v1.9.2-rc1 > v1.9
+func compareVersions(a, b string) int {
+	a = tagPrefix.ReplaceAllString(a, "")
+	b = tagPrefix.ReplaceAllString(b, "")
+	a, apre := splitPrerelease(a)
+	b, bpre := splitPrerelease(b)
+	if c := compareDotted(a, b); c != 0 {
+		return c
+	}
+	// A pre-release comes before the release
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	}
+	return compareDotted(apre, bpre)
+}
+
+// splitPrerelease splits 1.2.3-rc.1+build into 1.2.3 and rc.1
+func splitPrerelease(v string) (string, string) {
+	v = strings.SplitN(v, "+", 2)[0]
+	parts := strings.SplitN(v, "-", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return v, ""
+}
+
+// compareDotted compares dot separated identifiers, numerically when both are
+// numbers. Missing identifiers are lower.
+func compareDotted(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i >= len(as) {
+			return -1
+		} else if i >= len(bs) {
+			return 1
+		}
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			// Numeric identifiers are lower than alphanumeric ones
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"release-1.2", "v1.2", 0},
+		{"v1.10.0", "v1.9.2", 1},
+		{"v1.9.2", "v1.9.10", -1},
+		{"v1.9", "v1.9.2", -1},
+		{"v2", "v1.99.99", 1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+		{"1.0.0-rc.1+build", "1.0.0-rc.1", 0},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestLatestTag(t *testing.T) {
+	tags := []string{"v1.9.2", "v1.10.0-rc1", "v1.10.0", "v1.9.10", "latest", "debian/1.2-1", "v2.0.0-beta.1"}
+	tests := []struct {
+		pattern, re string
+		want        string
+	}{
+		{"", "", "v2.0.0-beta.1"},
+		{"v*", `^v[0-9.]+$`, "v1.10.0"},
+		{"v1.9.*", "", "v1.9.10"},
+		{"", `-rc`, "v1.10.0-rc1"},
+		{"debian/*", "", "debian/1.2-1"},
+		{"latest", "", ""},
+		{"v3.*", "", ""},
+	}
+	for _, test := range tests {
+		got, err := latestTag(tags, test.pattern, test.re)
+		if test.want == "" && err == nil {
+			t.Errorf("latestTag(%q, %q) = %q, want an error", test.pattern, test.re, got)
+		} else if test.want != "" && (err != nil || got != test.want) {
+			t.Errorf("latestTag(%q, %q) = %q, %v, want %q", test.pattern, test.re, got, err, test.want)
+		}
+	}
+}
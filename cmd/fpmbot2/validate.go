@@ -0,0 +1,54 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+	"internal/fpmconfig"
+)
+
+// validateRepository checks the package descriptions of the repository file
+// against the package schema, like fpmbuild checks its configuration, so the
+// errors point to the repository file. Packages without description are
+// checked in their <name>.yaml. It returns the problems of the defaults and of
+// each invalid package, prefixed with the file and line.
+func validateRepository(repo *Repository, repoyaml, reposrcdir string) (defaults error, packages map[string]error, err error) {
+	schema, err := packageSchema()
+	if err != nil {
+		return nil, nil, err
+	}
+	validate := func(file string, n *yaml.Node) error {
+		layer, err := fpmconfig.NodeLayer(file, n)
+		if err == nil {
+			err = fpmconfig.Validate(layer, schema)
+		}
+		return err
+	}
+
+	defaults = validate(repoyaml, &repo.Defaults)
+	packages = map[string]error{}
+	for _, item := range repo.Packages {
+		file, n := repoyaml, item.Value
+		if n == nil {
+			var doc yaml.Node
+			file = filepath.Join(reposrcdir, item.Name+".yaml")
+			err := readYAML(file, &doc)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				packages[item.Name] = fmt.Errorf("%s: %v", file, err)
+				continue
+			} else if len(doc.Content) == 0 {
+				continue
+			}
+			n = doc.Content[0]
+		}
+		if err := validate(file, n); err != nil {
+			packages[item.Name] = err
+		}
+	}
+	return defaults, packages, nil
+}
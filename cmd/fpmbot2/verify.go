@@ -0,0 +1,97 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyOptions lists the keys allowed to sign the source of a package
+type VerifyOptions struct {
+	GPGKeys           []string `yaml:"gpg-keys" doc:"Files containing the GPG public keys allowed to sign"`
+	SSHAllowedSigners string   `yaml:"ssh-allowed-signers" doc:"ssh allowed signers file (see ssh-keygen ALLOWED SIGNERS) listing the SSH keys allowed to sign"`
+}
+
+// resolve makes the key file paths absolute, relative to dir
+func (v *VerifyOptions) resolve(dir string) (err error) {
+	for i, f := range v.GPGKeys {
+		v.GPGKeys[i], err = absPath(dir, f)
+		if err != nil {
+			return err
+		}
+	}
+	if v.SSHAllowedSigners != "" {
+		v.SSHAllowedSigners, err = absPath(dir, v.SSHAllowedSigners)
+	}
+	return err
+}
+
+func absPath(dir, file string) (string, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	return filepath.Abs(file)
+}
+
+// VerifySignature checks that the planned commit (see PlannedRevision), or
+// the tag when tracking tags, has a valid signature from one of the allowed
+// keys. It is called before the checkout, so unverified sources never reach
+// the working tree.
+func (s *GitSource) VerifySignature() error {
+	v := s.Verify
+	if len(v.GPGKeys) == 0 && v.SSHAllowedSigners == "" {
+		return fmt.Errorf("verify: no gpg-keys or ssh-allowed-signers")
+	}
+
+	// Only the listed GPG keys are known to this temporary keyring
+	gnupghome, err := ioutil.TempDir("", "fpmbot2-gnupg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gnupghome)
+	env := append(os.Environ(), "GNUPGHOME="+gnupghome)
+	if len(v.GPGKeys) > 0 {
+		log.Printf("gpg --batch --import %s", strings.Join(v.GPGKeys, " "))
+		cmd := exec.Command("gpg", append([]string{"--batch", "--quiet", "--import"}, v.GPGKeys...)...)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("importing gpg keys: %v", err)
+		}
+	}
+
+	signers := v.SSHAllowedSigners
+	if signers == "" {
+		signers = os.DevNull
+	}
+	args := []string{"-c", "gpg.ssh.allowedSignersFile=" + signers}
+	commit := "HEAD"
+	if s.commit != "" {
+		commit = s.commit
+	}
+	what := "commit " + commit
+	if s.tag != "" {
+		args = append(args, "verify-tag", s.tag)
+		what = "tag " + s.tag
+	} else {
+		args = append(args, "verify-commit", commit)
+	}
+	log.Printf("git %s", strings.Join(args, " "))
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.Dir
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s of %s has no valid signature from the allowed keys", what, s.URL)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version of fpmbuild, set at build time with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// BuildKey returns a hash of the build inputs known to fpmbuild: its version,
+// the target, the merged configuration and the docker images. The source
+// itself is not part of the key. The output of docker goes to out.
+func BuildKey(fpmbuild *FPMBuildFile, target string, out io.Writer) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "fpmbuild %s\ntarget %s\n", Version, target)
+	config, err := yaml.Marshal(fpmbuild)
+	if err != nil {
+		return "", err
+	}
+	h.Write(config)
+	if docker := fpmbuild.Environment.Docker; docker != nil {
+		err = docker.hashImages(h, out)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashImages writes the ids of the images the phases start from to h. The
+// Dockerfile is built and missing images are pulled, with their output to out.
+func (env *DockerEnvironment) hashImages(h, out io.Writer) error {
+	image, err := env.image(DockerPhase{}, out)
+	if err != nil {
+		return err
+	}
+	images := []string{image}
+	for _, phase := range env.Phases {
+		if phase.Image != "" {
+			images = append(images, phase.Image)
+		}
+	}
+	sort.Strings(images[1:])
+	for _, image := range images {
+		id, err := imageID(image, out)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "image %s %s\n", image, id)
+	}
+	return nil
+}
+
+// imageID returns the id of a docker image, pulling it if needed with the
+// output of docker pull to out
+func imageID(image string, out io.Writer) (string, error) {
+	var id bytes.Buffer
+	cmd := docker("image", "inspect", "-f", "{{.Id}}", image)
+	cmd.Stdout = &id
+	cmd.Stderr = nil
+	if cmd.Run() != nil {
+		log.Printf("docker pull %s", image)
+		cmd = docker("pull", image)
+		cmd.Stdout = out
+		err := cmd.Run()
+		if err != nil {
+			return "", err
+		}
+		id.Reset()
+		cmd = docker("image", "inspect", "-f", "{{.Id}}", image)
+		cmd.Stdout = &id
+		err = cmd.Run()
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(id.String()), nil
+}
@@ -0,0 +1,55 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "fpmbuild-cache")
+	}
+	return filepath.Join(dir, "fpmbuild")
+}
+
+// Hash identifies the build environment so that caches filled by one image
+// are not reused by an incompatible one.
+func (env *DockerEnvironment) Hash() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(env.Image+"\n"+env.Dockerfile)))
+}
+
+// cacheVolumes returns the docker volume specifications backing each cache
+// path with a persistent host directory under
+// <cachedir>/<name>/<environment hash>/
+func cacheVolumes(cachedir, name string, env *DockerEnvironment, paths []string) ([]string, error) {
+	var volumes []string
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("cache path %s must be absolute", p)
+		}
+		key := strings.Replace(strings.Trim(filepath.Clean(p), "/"), "/", "_", -1)
+		dir := filepath.Join(cachedir, name, env.Hash(), key)
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Cache %s in %s", p, dir)
+		volumes = append(volumes, dir+":"+p)
+	}
+	return volumes, nil
+}
+
+func clearCache(cachedir, name string) error {
+	if name == "" {
+		return fmt.Errorf("cannot clear cache: unknown package name")
+	}
+	dir := filepath.Join(cachedir, name)
+	log.Printf("rm -rf %s", dir)
+	return os.RemoveAll(dir)
+}
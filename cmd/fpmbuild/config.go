@@ -2,13 +2,10 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 var defaultFile FPMBuildFile = FPMBuildFile{
@@ -27,104 +24,113 @@ var defaultFile FPMBuildFile = FPMBuildFile{
 }
 
 type FPMBuildFile struct {
-	Build       FPMBuildInfo        `yaml:"build"`
-	Clean       string              `yaml:"clean"`
-	FPM         []string            `yaml:"fpm"`
-	FPMHooks    map[string]string   `yaml:"fpm-hooks"`
-	Environment FPMBuildEnvironment `yaml:"env"`
+	Build       FPMBuildInfo        `yaml:"build" doc:"Build commands, executed in order: prepare, build, fpmgen and install"`
+	Clean       string              `yaml:"clean" doc:"git clean options, the source is cleaned before the build if not empty (for example -fdx)"`
+	FPM         []string            `yaml:"fpm" doc:"Additional fpm options, replaces the .fpm file"`
+	Package     FPMPackage          `yaml:"package" doc:"Structured fpm options, given to fpm before the fpm options"`
+	Outputs     []FPMOutput         `yaml:"outputs" doc:"Split the build in multiple packages, fpm is executed once per output. Requires package.chdir, excludes package.paths"`
+	FPMHooks    map[string]string   `yaml:"fpm-hooks" doc:"fpm scripts by option name (before-install, after-install, ...)"`
+	Environment FPMBuildEnvironment `yaml:"env" doc:"Build environment, the build runs on the host if not specified"`
+	Cache       []string            `yaml:"cache" doc:"Paths in the docker container kept across builds"`
+	Variables   map[string]string   `yaml:"environment" doc:"Environment variables given to the build commands"`
+	Secrets     []Secret            `yaml:"secrets" doc:"Files made available to the build commands in the directory named by $FPMBUILD_SECRETS"`
+	Version     FPMBuildVersion     `yaml:"version" doc:"Package version"`
+	Metadata    FPMBuildMetadata    `yaml:"metadata" doc:"Package metadata"`
+	Vars        map[string]string   `yaml:"vars" template:"-" doc:"Variables for the templates ({{.Vars.name}})"`
 }
 
 type FPMBuildInfo struct {
-	Prepare   string   `yaml:"prepare"`
-	FPMGen    string   `yaml:"fpmgen"`
-	Build     string   `yaml:"build"`
-	Install   string   `yaml:"install"`
-	Shell     string   `yaml:"shell"`
-	Options   []string `yaml:"options"`
-	Arguments []string `yaml:"arguments"`
+	Prepare   string   `yaml:"prepare" doc:"Commands run first, as root and with network access in docker"`
+	FPMGen    string   `yaml:"fpmgen" doc:"Commands generating the .fpm file"`
+	Build     string   `yaml:"build" doc:"Build commands"`
+	Install   string   `yaml:"install" doc:"Commands installing the files to package"`
+	Shell     string   `yaml:"shell" doc:"Shell executing the commands"`
+	Options   []string `yaml:"options" doc:"Shell options, before the commands"`
+	Arguments []string `yaml:"arguments" doc:"Shell arguments, after the commands"`
 }
 
 type FPMBuildEnvironment struct {
-	Docker *DockerEnvironment `yaml:"docker"`
+	Docker *DockerEnvironment `yaml:"docker" doc:"Build in docker containers"`
 }
 
 type DockerEnvironment struct {
-	Image      string `yaml:"image"`
-	Dockerfile string `yaml:"Dockerfile"`
-	SrcPath    string `yaml:"srcpath"`
+	Image      string                 `yaml:"image" doc:"Image name, incompatible with Dockerfile (default is debian:stable)"`
+	Dockerfile string                 `yaml:"Dockerfile" doc:"Dockerfile of the image"`
+	SrcPath    string                 `yaml:"srcpath" doc:"Source directory in the container (default is /src)"`
+	Network    string                 `yaml:"network" doc:"none or default. With none, only the prepare commands have access to the network"`
+	CPUs       string                 `yaml:"cpus" doc:"Number of CPUs (default is unlimited)"`
+	Memory     string                 `yaml:"memory" doc:"Memory limit, exit status 137 when reached (default is unlimited)"`
+	Timeout    string                 `yaml:"timeout" doc:"Build duration limit, exit status 124 when reached (default is unlimited)"`
+	ReadOnly   bool                   `yaml:"read-only" doc:"Mount the container root filesystem read-only, except for the prepare phase"`
+	SSHAgent   bool                   `yaml:"ssh-agent" doc:"Forward the host ssh-agent to the container"`
+	KnownHosts string                 `yaml:"known-hosts" doc:"Host keys accepted by ssh in the container (git over ssh)"`
+	Phases     map[string]DockerPhase `yaml:"phases" doc:"Per phase options: prepare, build, fpmgen or install"`
+
+	// Additional volumes (host:container) and environment variables, not
+	// configurable from YAML
+	Volumes   []string          `yaml:"-"`
+	Variables map[string]string `yaml:"-"`
+	// Cache volumes, not mounted in the phases running as root so the
+	// cache only contains files the user can remove
+	CacheVolumes []string `yaml:"-"`
+
+	images   []string
+	deadline time.Time
+}
+
+// DockerPhase overrides the docker environment for a build phase
+type DockerPhase struct {
+	User    string `yaml:"user" doc:"user[:group] running the phase. Default is root for prepare and the user running fpmbuild for other phases"`
+	Network string `yaml:"network" doc:"none or default"`
+	Image   string `yaml:"image" doc:"Run the phase in this image instead of the image resulting from the previous phase"`
+}
+
+// A BuildPhase is one step of the build, executed in its own container
+type BuildPhase struct {
+	Name   string
+	Script string
 }
 
-func (i *FPMBuildInfo) Command() []string {
+// Phases returns the non empty build phases in execution order
+func (i *FPMBuildInfo) Phases() []BuildPhase {
+	var phases []BuildPhase
+	for _, phase := range []BuildPhase{
+		{"prepare", i.Prepare},
+		{"build", i.Build},
+		{"fpmgen", i.FPMGen},
+		{"install", i.Install},
+	} {
+		if strings.TrimSpace(phase.Script) != "" {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
+
+func (i *FPMBuildInfo) Command(phase BuildPhase) []string {
 	res := []string{i.Shell}
 	res = append(res, i.Options...)
-	res = append(res,
-		"\n"+
-			i.Prepare+"\n"+
-			i.Build+"\n"+
-			i.FPMGen+"\n"+
-			i.Install+"\n")
+	res = append(res, "\n"+phase.Script+"\n")
 	res = append(res, i.Arguments...)
 	return res
 }
 
 type Environment interface {
-	Execute(command []string) error
+	Execute(phase string, command []string) error
+	Close() error
 }
 
-var dockerSudo bool = false
-
-func (env *DockerEnvironment) Execute(command []string) error {
-	image := env.Image
-	srcPath := env.SrcPath
-	dockerfile := []byte(env.Dockerfile)
-	if len(dockerfile) > 0 {
-		image = fmt.Sprintf("fpmbuild:%x", sha1.Sum(dockerfile))
-		buildargs := []string{"docker", "build", "-t", image, "-"}
-		if dockerSudo {
-			buildargs = append([]string{"sudo"}, buildargs...)
-		}
-		log.Println(strings.Join(buildargs, " "))
-		cmd := exec.Command(buildargs[0], buildargs[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = bytes.NewReader(dockerfile)
-		err := cmd.Run()
-		if err != nil {
-			return err
-		}
-	}
-	if image == "" {
-		image = "debian:stable"
-	}
-	if srcPath == "" {
-		srcPath = "/src"
-	}
-	cwd, err := os.Getwd()
-	if err != nil {
-		return err
-	}
-	uid := os.Getuid()
-	gid := os.Getgid()
-	args := []string{"docker", "run", "--rm",
-		"-v", cwd + ":" + srcPath,
-		"-u", fmt.Sprintf("%d:%d", uid, gid),
-		"-w", srcPath,
-		image}
-	if dockerSudo {
-		args = append([]string{"sudo"}, args...)
-	}
-	log.Printf("%s ...", strings.Join(args, " "))
-	args = append(args, command...)
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+type DefaultEnvironment struct {
+	Variables map[string]string
 }
 
-type DefaultEnvironment struct{}
+func (env *DefaultEnvironment) Close() error {
+	return nil
+}
 
-func (env *DefaultEnvironment) Execute(command []string) error {
+func (env *DefaultEnvironment) Execute(phase string, command []string) error {
 	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), environ(env.Variables)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
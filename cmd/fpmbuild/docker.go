@@ -0,0 +1,245 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var dockerSudo bool = false
+
+// Errors returned when the build hits a resource limit
+var (
+	ErrTimeout     = errors.New("build timed out")
+	ErrOutOfMemory = errors.New("build ran out of memory")
+)
+
+var containerCount int = 0
+
+func docker(args ...string) *exec.Cmd {
+	if dockerSudo {
+		args = append([]string{"sudo", "docker"}, args...)
+	} else {
+		args = append([]string{"docker"}, args...)
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Execute runs a build phase in its own container. Unless it is the install
+// phase, the container is committed to a temporary image so the next phase
+// starts where it left. Close must be called to remove those images.
+func (env *DockerEnvironment) Execute(phase string, command []string) error {
+	container, err := env.run(phase, command)
+	if container == "" {
+		return err
+	}
+	defer env.remove(container)
+	if err != nil || phase == "install" {
+		return err
+	}
+	image := "fpmbuild-phase:" + container
+	log.Printf("docker commit %s %s", container, image)
+	cmd := docker("commit", container, image)
+	cmd.Stdout = nil
+	err = cmd.Run()
+	if err != nil {
+		return err
+	}
+	env.images = append(env.images, image)
+	return nil
+}
+
+func (env *DockerEnvironment) Close() error {
+	if len(env.images) == 0 {
+		return nil
+	}
+	log.Printf("docker rmi %s", strings.Join(env.images, " "))
+	cmd := docker(append([]string{"rmi"}, env.images...)...)
+	cmd.Stdout = nil
+	err := cmd.Run()
+	env.images = nil
+	return err
+}
+
+// image returns the image to run, building the Dockerfile if needed with the
+// output of docker build to out
+func (env *DockerEnvironment) image(phase DockerPhase, out io.Writer) (string, error) {
+	if phase.Image != "" {
+		return phase.Image, nil
+	}
+	if len(env.images) > 0 {
+		return env.images[len(env.images)-1], nil
+	}
+	image := env.Image
+	dockerfile := []byte(env.Dockerfile)
+	if len(dockerfile) > 0 {
+		image = fmt.Sprintf("fpmbuild:%x", sha1.Sum(dockerfile))
+		log.Printf("docker build -t %s -", image)
+		cmd := docker("build", "-t", image, "-")
+		cmd.Stdin = bytes.NewReader(dockerfile)
+		cmd.Stdout = out
+		err := cmd.Run()
+		if err != nil {
+			return "", err
+		}
+	}
+	if image == "" {
+		image = "debian:stable"
+	}
+	return image, nil
+}
+
+// validate checks the values docker would not check before the build
+func (env *DockerEnvironment) validate() error {
+	networks := map[string]string{"": env.Network}
+	for name, phase := range env.Phases {
+		networks["phases."+name+"."] = phase.Network
+	}
+	for path, network := range networks {
+		if network != "" && network != "none" && network != "default" {
+			return fmt.Errorf("env.docker.%snetwork: %q must be none or default", path, network)
+		}
+	}
+	return nil
+}
+
+// phase returns the options of a build phase with defaults applied
+func (env *DockerEnvironment) phase(name string) DockerPhase {
+	phase := env.Phases[name]
+	if phase.User == "" && name == "prepare" {
+		phase.User = "root"
+	} else if phase.User == "" {
+		phase.User = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	}
+	if phase.Network == "" && name == "prepare" {
+		phase.Network = "default"
+	} else if phase.Network == "" {
+		phase.Network = env.Network
+	}
+	return phase
+}
+
+// isRoot tells if a docker user[:group] specification is the root user
+func isRoot(user string) bool {
+	user = strings.SplitN(user, ":", 2)[0]
+	return user == "root" || user == "0"
+}
+
+// run executes the command in a new container and returns the container name.
+// The container is not removed.
+func (env *DockerEnvironment) run(name string, command []string) (string, error) {
+	if env.deadline.IsZero() && env.Timeout != "" {
+		timeout, err := time.ParseDuration(env.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("invalid timeout %s: %v", env.Timeout, err)
+		}
+		env.deadline = time.Now().Add(timeout)
+	}
+
+	phase := env.phase(name)
+	image, err := env.image(phase, os.Stdout)
+	if err != nil {
+		return "", err
+	}
+	srcPath := env.SrcPath
+	if srcPath == "" {
+		srcPath = "/src"
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	containerCount++
+	container := fmt.Sprintf("fpmbuild-%s-%d-%d", name, os.Getpid(), containerCount)
+	args := []string{"run", "--name", container,
+		"-v", cwd + ":" + srcPath,
+		"-u", phase.User,
+		"-w", srcPath}
+	for _, v := range env.Volumes {
+		args = append(args, "-v", v)
+	}
+	if len(env.CacheVolumes) > 0 && isRoot(phase.User) && os.Getuid() != 0 {
+		log.Printf("Phase %s runs as root, without the cache", name)
+	} else {
+		for _, v := range env.CacheVolumes {
+			args = append(args, "-v", v)
+		}
+	}
+	for _, e := range environ(env.Variables) {
+		args = append(args, "-e", e)
+	}
+	if phase.Network != "" && phase.Network != "default" {
+		args = append(args, "--network", phase.Network)
+	}
+	if env.CPUs != "" {
+		args = append(args, "--cpus", env.CPUs)
+	}
+	if env.Memory != "" {
+		args = append(args, "--memory", env.Memory, "--memory-swap", env.Memory)
+	}
+	// prepare installs the build dependencies, its root must be writable
+	if env.ReadOnly && name != "prepare" {
+		args = append(args, "--read-only", "--tmpfs", "/tmp")
+	}
+	args = append(args, image)
+	log.Printf("docker %s ...", mask(strings.Join(args, " ")))
+	args = append(args, command...)
+	cmd := docker(args...)
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if !env.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(env.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err = <-done:
+	case <-timeout:
+		log.Printf("Timeout of %s reached, docker kill %s", env.Timeout, container)
+		kill := docker("kill", container)
+		kill.Stdout = nil
+		if e := kill.Run(); e != nil {
+			log.Println(e)
+		}
+		<-done
+		return container, ErrTimeout
+	}
+
+	if err != nil && env.Memory != "" {
+		var oom bytes.Buffer
+		inspect := docker("inspect", "-f", "{{.State.OOMKilled}}", container)
+		inspect.Stdout = &oom
+		if inspect.Run() == nil && strings.TrimSpace(oom.String()) == "true" {
+			return container, ErrOutOfMemory
+		}
+	}
+	return container, err
+}
+
+func (env *DockerEnvironment) remove(container string) {
+	cmd := docker("rm", "-f", container)
+	cmd.Stdout = nil
+	err := cmd.Run()
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -2,47 +2,80 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+	"internal/fpmconfig"
 )
 
 func main() {
 	var res int = 0
 	defer func() { os.Exit(res) }()
 
-	repoYAMLFile := flag.String("config", "", "YAML configuration")
+	var configFlags stringsFlag
+	flag.Var(&configFlags, "config", "YAML configuration, merged over .fpmbuild.yaml (can be repeated)")
+	confDir := flag.String("confdir", "/etc/fpmbuild.d", "System configuration directory")
 	sudoFlag := flag.Bool("sudo", false, "Use sudo to invoke docker")
 	target := flag.String("t", "", "FPM target")
 	outPath := flag.String("o", ".", "Output (directory or file)")
 	forceFPM := flag.Bool("f", true, "Force writing package (fpm option -f)")
+	cacheDir := flag.String("cachedir", defaultCacheDir(), "Directory holding the build caches")
+	stateFile := flag.String("state", "", "Build state file (default is <source directory>.fpmbuild-state)")
+	clearCacheFlag := flag.Bool("clear-cache", false, "Remove the build caches of the package and exit")
+	checkFlag := flag.Bool("check", false, "Validate the configuration and exit")
+	schemaFlag := flag.Bool("schema", false, "Print the JSON Schema of the configuration and exit")
+	printConfig := flag.Bool("print-config", false, "Print the configuration with the origin of each value and exit")
+	buildKeyFlag := flag.Bool("build-key", false, "Print a hash of the build inputs except the source and exit")
+	versionFlag := flag.Bool("version", false, "Print the fpmbuild version and exit")
+	var setFlags stringsFlag
+	flag.Var(&setFlags, "set", "Set a configuration value: path.to.key=value (can be repeated)")
 	flag.Parse()
 	args := flag.Args()
 	dockerSudo = *sudoFlag
-	fmt.Println("fpmbuild starting...")
 
-	var configFile, packageFile FPMBuildFile
+	if *versionFlag {
+		fmt.Println(Version)
+		return
+	}
 
-	if *repoYAMLFile != "" {
-		err := readYAML(*repoYAMLFile, &configFile)
+	if *schemaFlag {
+		schema, err := Schema()
 		if err != nil {
 			log.Println(err)
+			res = 1
+			return
 		}
-	}
-	err := readYAML(".fpmbuild.yaml", &packageFile)
-	if err != nil {
-		log.Println(err)
+		fmt.Println(string(schema))
+		return
 	}
 
-	fpmbuild := merge(merge(configFile, packageFile), defaultFile)
+	// Paths given on the command line are relative to the current directory
+	paths := []*string{confDir, cacheDir, stateFile}
+	for i := range configFlags {
+		paths = append(paths, &configFlags[i])
+	}
+	for _, path := range paths {
+		if *path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*path)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		*path = abs
+	}
 
 	if len(args) > 0 {
 		err := os.Chdir(args[0])
@@ -53,180 +86,380 @@ func main() {
 		}
 	}
 
-	if fpmbuild.Clean != "" {
-		args := []string{"clean"}
-		args = append(args, fpmbuild.Clean)
-		log.Printf("git %s", strings.Join(args, " "))
-		cmd := exec.Command("git", args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
+	layer, err := fpmconfig.ObjectLayer("default", defaultFile)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	layers := []*fpmconfig.Layer{layer}
+	sysfiles, err := filepath.Glob(filepath.Join(*confDir, "*.yaml"))
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	for _, filename := range append(append(sysfiles, ".fpmbuild.yaml"), configFlags...) {
+		layer, err := fpmconfig.ReadLayer(filename)
+		if os.IsNotExist(err) && filename == ".fpmbuild.yaml" {
+			continue
+		} else if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		layers = append(layers, layer)
+	}
+	for _, spec := range setFlags {
+		layer, err := fpmconfig.SetLayer(spec)
 		if err != nil {
 			log.Println(err)
 			res = 1
 			return
 		}
+		layers = append(layers, layer)
 	}
 
-	var env Environment
-	if fpmbuild.Environment.Docker != nil {
-		log.Println("Use Docker")
-		env = fpmbuild.Environment.Docker
-	} else {
-		log.Println("Use Host system")
-		env = &DefaultEnvironment{}
+	var fpmbuild FPMBuildFile
+	merged, err := fpmconfig.MergeLayers(layers, &fpmbuild)
+	if err == nil {
+		err = validateOutputs(&fpmbuild.Package, fpmbuild.Outputs)
+	}
+	if err == nil && fpmbuild.Environment.Docker != nil {
+		err = fpmbuild.Environment.Docker.validate()
 	}
-
-	command := fpmbuild.Build.Command()
-	log.Println(strings.Join(command, " "))
-	err = env.Execute(command)
 	if err != nil {
 		log.Println(err)
 		res = 1
 		return
 	}
 
-	opts := ""
-	path, err := os.Getwd()
-	if err != nil {
-		log.Println(err)
-	} else {
-		base := filepath.Base(path)
-		if base != "" && base != "." {
-			opts += " --name=" + shellEscape(base)
+	if *checkFlag {
+		log.Println("Configuration is valid")
+		return
+	}
+
+	if *printConfig {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		err = enc.Encode(merged)
+		if err != nil {
+			log.Println(err)
+			res = 1
 		}
+		return
 	}
 
-	cmd := exec.Command("git", "rev-parse")
-	cmd.Stdin = nil
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	if cmd.Run() == nil {
+	if *buildKeyFlag {
+		// docker build output must not mix with the key
+		key, err := BuildKey(&fpmbuild, *target, os.Stderr)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		fmt.Println(key)
+		return
+	}
 
-		// Compute staging area hash
+	fmt.Println("fpmbuild starting...")
 
-		dirtymark := ".dirty"
-		environ := os.Environ()
-		environ = append(environ, "GIT_INDEX_FILE=.git/index-fpm-dirty")
-		os.Remove(".git/index-fpm-dirty")
-		defer func() { os.Remove(".git/index-fpm-dirty") }()
+	var discovered FPMBuildMetadata
+	if fpmbuild.Metadata.Discover {
+		discovered.DiscoverMetadata()
+	}
+	name := mergeString(fpmbuild.Metadata.Name, packageName())
 
-		cmd := exec.Command("git", "add", "-u")
-		cmd.Env = environ
+	if *clearCacheFlag {
+		err := clearCache(*cacheDir, name)
+		if err != nil {
+			log.Println(err)
+			res = 1
+		}
+		return
+	}
+
+	version, err := fpmbuild.Version.Version()
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+
+	srcPath, err := os.Getwd()
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	if docker := fpmbuild.Environment.Docker; docker != nil {
+		srcPath = mergeString(docker.SrcPath, "/src")
+	}
+	data := &TemplateData{
+		Name:    name,
+		Version: version,
+		Target:  *target,
+		SrcPath: srcPath,
+		GitRev:  gitRev(),
+	}
+	err = expandTemplates(&fpmbuild, data)
+	if err != nil {
+		log.Println(err)
+		res = 1
+		return
+	}
+	metadata := fpmbuild.Metadata
+	metadata.fill(discovered)
+
+	if fpmbuild.Clean != "" {
+		args := []string{"clean"}
+		args = append(args, fpmbuild.Clean)
+		log.Printf("git %s", strings.Join(args, " "))
+		cmd := exec.Command("git", args...)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		err := cmd.Run()
 		if err != nil {
 			log.Println(err)
-		} else {
-			cmd := exec.Command("git", "reset")
-			cmd.Env = environ
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				log.Println(err)
-			}
+			res = 1
+			return
+		}
+	}
+
+	variables := map[string]string{}
+	for k, v := range fpmbuild.Variables {
+		variables[k] = v
+	}
+	if version != "" {
+		log.Printf("Version %s", version)
+		variables["FPMBUILD_VERSION"] = version
+	}
+
+	secretsdir := ""
+	if len(fpmbuild.Secrets) > 0 {
+		secretsdir, err = writeSecrets(fpmbuild.Secrets)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
 		}
-		if err == nil {
-			var hash bytes.Buffer
-			cmd := exec.Command("git", "write-tree")
-			cmd.Env = environ
-			cmd.Stdout = &hash
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
+		defer os.RemoveAll(secretsdir)
+	}
+
+	var env Environment
+	if docker := fpmbuild.Environment.Docker; docker != nil {
+		log.Println("Use Docker")
+		if len(fpmbuild.Cache) > 0 {
+			volumes, err := cacheVolumes(*cacheDir, name, docker, fpmbuild.Cache)
 			if err != nil {
 				log.Println(err)
-			} else {
-				dirtymark += "." + string(hash.Bytes()[0:7])
+				res = 1
+				return
 			}
+			docker.CacheVolumes = volumes
+		}
+		if secretsdir != "" {
+			docker.Volumes = append(docker.Volumes, secretsdir+":"+secretsPath+":ro")
+			variables["FPMBUILD_SECRETS"] = secretsPath
 		}
+		err := docker.setupSSH(variables)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		docker.Variables = variables
+		env = docker
+	} else {
+		log.Println("Use Host system")
+		if secretsdir != "" {
+			variables["FPMBUILD_SECRETS"] = secretsdir
+		}
+		env = &DefaultEnvironment{Variables: variables}
+	}
 
-		// Describe Git HEAD
-
-		var buf bytes.Buffer
-		cmd = exec.Command("git", "describe", "--dirty="+dirtymark)
-		cmd.Stdout = &buf
-		if cmd.Run() == nil {
-			ver := ""
-			for _, b := range buf.Bytes() {
-				if ver == "" {
-					if b >= '0' && b <= '9' {
-						ver += string([]byte{b})
-					}
-				} else if (b < '0' || b > '9') &&
-					(b < 'a' || b > 'z') &&
-					(b < 'A' || b > 'Z') {
-					ver += "."
-				} else {
-					ver += string([]byte{b})
-				}
-			}
-			ver = strings.TrimRight(ver, ".")
-			opts += " --version=" + shellEscape(ver)
+	defer func() {
+		err := env.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}()
 
-		} else {
+	for _, phase := range fpmbuild.Build.Phases() {
+		command := fpmbuild.Build.Command(phase)
+		log.Printf("Phase %s: %s", phase.Name, mask(strings.Join(command, " ")))
+		start := time.Now()
+		err = env.Execute(phase.Name, command)
+		if err != nil {
+			log.Printf("Phase %s failed after %s: %v", phase.Name, time.Since(start), err)
+			res = exitStatus(err)
+			return
+		}
+		log.Printf("Phase %s finished in %s", phase.Name, time.Since(start))
+	}
 
-			buf.Reset()
-			cmd = exec.Command("git", "describe", "--dirty="+dirtymark, "--always", "--tags")
-			cmd.Stdout = &buf
-			if err := cmd.Run(); err != nil {
-				log.Println(err)
-			} else {
-				ver := "0." + strings.Trim(string(buf.Bytes()), " \n")
-				opts += " --version=" + shellEscape(ver)
-			}
+	opts := ""
+	if version != "" {
+		opts += " --version=" + shellEscape(version)
+	}
+	if fpmbuild.Version.Epoch != "" {
+		opts += " --epoch=" + shellEscape(fpmbuild.Version.Epoch)
+	}
+	opts += metadata.FPMOptions()
+
+	var state BuildState
+	iteration := fpmbuild.Version.Iteration
+	if iteration == "" && version != "" {
+		if *stateFile == "" {
+			*stateFile = defaultStateFile()
 		}
+		state, err = nextIteration(*stateFile, version)
+		if err != nil {
+			log.Println(err)
+			res = 1
+			return
+		}
+		log.Printf("Build %d of version %s", state.Iteration, version)
+		iteration = strconv.Itoa(state.Iteration)
+	}
+	if iteration != "" {
+		opts += " --iteration=" + shellEscape(iteration)
 	}
 
 	args = []string{"-t", *target, "-p", *outPath}
 	if *forceFPM {
 		args = append(args, "-f")
 	}
-	var tempfiles []string
-	defer func() {
-		for _, f := range tempfiles {
-			err := os.Remove(f)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-	}()
-	for k, v := range fpmbuild.FPMHooks {
-		log.Printf("fpm %s:\n  %s", k, strings.Replace(v, "\n", "\n  ", -1))
-		f, err := ioutil.TempFile("", k)
+	args = append(args, fpmbuild.Package.Args()...)
+
+	if len(fpmbuild.Outputs) == 0 {
+		err = runFPM(name, opts, args, fpmbuild.FPMHooks, fpmbuild.FPM, fpmbuild.Package.Paths)
 		if err != nil {
 			log.Println(err)
 			res = 1
 			return
 		}
-		tempfiles = append(tempfiles, f.Name())
-		defer f.Close()
-		_, err = f.Write([]byte(v))
+	} else {
+		fullVersion := version
+		if fpmbuild.Version.Epoch != "" {
+			fullVersion = fpmbuild.Version.Epoch + ":" + fullVersion
+		}
+		if iteration != "" {
+			fullVersion += "-" + iteration
+		}
+		inputs, err := outputInputs(fpmbuild.Package.Chdir, fpmbuild.Outputs)
 		if err != nil {
 			log.Println(err)
 			res = 1
 			return
 		}
-		err = os.Chmod(f.Name(), 0755)
+		for i, output := range fpmbuild.Outputs {
+			outname := name + output.Suffix
+			log.Printf("Output %s", outname)
+			outargs := append([]string{}, args...)
+			for _, dep := range output.Depends {
+				outargs = append(outargs, "--depends", pinDepends(dep, name, fullVersion, fpmbuild.Outputs))
+			}
+			hooks := mergeStringMap(output.Hooks, fpmbuild.FPMHooks)
+			inputsfile, err := writeTempFile("inputs", strings.Join(inputs[i], "\n")+"\n")
+			if err != nil {
+				log.Println(err)
+				res = 1
+				return
+			}
+			defer os.Remove(inputsfile)
+			outargs = append(outargs, "--inputs", inputsfile)
+			err = runFPM(outname, opts, outargs, hooks, fpmbuild.FPM, nil)
+			if err != nil {
+				log.Println(err)
+				res = 1
+				return
+			}
+		}
+	}
+
+	if state.Iteration > 0 {
+		err = writeState(*stateFile, state)
 		if err != nil {
 			log.Println(err)
 			res = 1
-			return
 		}
-		args = append(args, "--"+k, f.Name())
 	}
-	args = append(args, fpmbuild.FPM...)
-	log.Printf("fpm [%s ] %s", opts, strings.Join(args, " "))
-	cmd = exec.Command("fpm", args...)
+}
+
+// runFPM executes fpm for the package name with the given hooks, and the fpm
+// options and arguments following args
+func runFPM(name, opts string, args []string, hooks map[string]string, fpmargs, paths []string) error {
+	if name != "" {
+		opts = " --name=" + shellEscape(name) + opts
+	}
+	args = append([]string{}, args...)
+	for k, v := range hooks {
+		log.Printf("fpm %s:\n  %s", k, strings.Replace(v, "\n", "\n  ", -1))
+		f, err := writeTempFile(k, v)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f)
+		err = os.Chmod(f, 0755)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--"+k, f)
+	}
+	args = append(args, fpmargs...)
+	args = append(args, paths...)
+	log.Printf("fpm [%s ] %s", opts, mask(strings.Join(args, " ")))
+	cmd := exec.Command("fpm", args...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 	cmd.Env = append(os.Environ(), "FPMOPTS="+opts)
-	err = cmd.Run()
+	return cmd.Run()
+}
+
+func writeTempFile(prefix, content string) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.Write([]byte(content))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Exit status of fpmbuild when the build hits a resource limit
+const (
+	exitTimeout     = 124
+	exitOutOfMemory = 137
+)
+
+func exitStatus(err error) int {
+	switch err {
+	case ErrTimeout:
+		return exitTimeout
+	case ErrOutOfMemory:
+		return exitOutOfMemory
+	default:
+		return 1
+	}
+}
+
+// packageName returns the package name, the current directory name
+func packageName() string {
+	path, err := os.Getwd()
 	if err != nil {
 		log.Println(err)
-		res = 1
+		return ""
+	}
+	base := filepath.Base(path)
+	if base == "." || base == string(filepath.Separator) {
+		return ""
 	}
+	return base
 }
 
 func shellEscape(s string) string {
@@ -240,11 +473,15 @@ func readYAML(filename string, obj interface{}) error {
 		return err
 	}
 	defer f.Close()
-	bytes, err := ioutil.ReadAll(f)
-	if err != nil {
-		return err
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(obj)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
 	}
-	return yaml.Unmarshal(bytes, obj)
+	return nil
 }
 
 func mergeString(file1, file2 string) string {
@@ -255,14 +492,6 @@ func mergeString(file1, file2 string) string {
 	}
 }
 
-func mergeStrings(file1, file2 []string) []string {
-	if file1 != nil {
-		return file1
-	} else {
-		return file2
-	}
-}
-
 func mergeStringMap(file1, file2 map[string]string) map[string]string {
 	res := map[string]string{}
 	for k, v := range file2 {
@@ -282,22 +511,14 @@ func mergeStringMap(file1, file2 map[string]string) map[string]string {
 	return res
 }
 
-func merge(file1, file2 FPMBuildFile) (res FPMBuildFile) {
-	res.Build.Prepare = mergeString(file1.Build.Prepare, file2.Build.Prepare)
-	res.Build.FPMGen = mergeString(file1.Build.FPMGen, file2.Build.FPMGen)
-	res.Build.Build = mergeString(file1.Build.Build, file2.Build.Build)
-	res.Build.Install = mergeString(file1.Build.Install, file2.Build.Install)
-	res.Build.Shell = mergeString(file1.Build.Shell, file2.Build.Shell)
-	res.Build.Options = mergeStrings(file1.Build.Options, file2.Build.Options)
-	res.Build.Arguments = mergeStrings(file1.Build.Arguments, file2.Build.Arguments)
-	res.FPM = mergeStrings(file1.FPM, file2.FPM)
-	res.FPMHooks = mergeStringMap(file1.FPMHooks, file2.FPMHooks)
-	res.Clean = mergeString(file1.Clean, file2.Clean)
-
-	if file1.Environment.Docker != nil {
-		res.Environment = file1.Environment
-	} else {
-		res.Environment = file2.Environment
-	}
-	return res
+// stringsFlag is a command line flag that can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
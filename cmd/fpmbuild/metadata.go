@@ -0,0 +1,253 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type FPMBuildMetadata struct {
+	Discover    bool   `yaml:"discover" doc:"Discover missing metadata from the project files (go.mod, package.json, Cargo.toml, pyproject.toml, setup.py, debian/control), except the name"`
+	Name        string `yaml:"name" template:"-" doc:"Package name, defaults to the source directory name"`
+	Description string `yaml:"description" doc:"Package description"`
+	License     string `yaml:"license" doc:"Package license"`
+	URL         string `yaml:"url" doc:"Project home page"`
+	Maintainer  string `yaml:"maintainer" doc:"Package maintainer"`
+	Vendor      string `yaml:"vendor" doc:"Package vendor"`
+}
+
+// FPMOptions returns the fpm options for the metadata, except the name
+func (m *FPMBuildMetadata) FPMOptions() string {
+	opts := ""
+	for _, opt := range []struct{ name, value string }{
+		{"description", m.Description},
+		{"license", m.License},
+		{"url", m.URL},
+		{"maintainer", m.Maintainer},
+		{"vendor", m.Vendor},
+	} {
+		if opt.value != "" {
+			opts += " --" + opt.name + "=" + shellEscape(opt.value)
+		}
+	}
+	return opts
+}
+
+// fill sets the metadata not already set from m2, except the name
+func (m *FPMBuildMetadata) fill(m2 FPMBuildMetadata) {
+	m.Description = mergeString(m.Description, m2.Description)
+	m.License = mergeString(m.License, m2.License)
+	m.URL = mergeString(m.URL, m2.URL)
+	m.Maintainer = mergeString(m.Maintainer, m2.Maintainer)
+	m.Vendor = mergeString(m.Vendor, m2.Vendor)
+}
+
+// DiscoverMetadata completes the metadata with information found in the
+// project files of the current directory. The name is not discovered, it
+// would change the package name and cache directory with the project files.
+func (m *FPMBuildMetadata) DiscoverMetadata() {
+	for _, d := range []struct {
+		file     string
+		discover func(data []byte) FPMBuildMetadata
+	}{
+		{"debian/control", debianControlMetadata},
+		{"package.json", packageJSONMetadata},
+		{"Cargo.toml", cargoMetadata},
+		{"pyproject.toml", pyprojectMetadata},
+		{"setup.py", setupPyMetadata},
+		{"go.mod", goModMetadata},
+	} {
+		data, err := ioutil.ReadFile(d.file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Println(err)
+			continue
+		}
+		log.Printf("Reading metadata from %s", d.file)
+		m.fill(d.discover(data))
+	}
+}
+
+func debianControlMetadata(data []byte) (m FPMBuildMetadata) {
+	inBinary := false
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if inBinary {
+				// Only the first binary package is considered
+				break
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation lines (long description) are ignored
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+		switch field {
+		case "package":
+			inBinary = true
+		case "maintainer":
+			m.Maintainer = mergeString(m.Maintainer, value)
+		case "homepage":
+			m.URL = mergeString(m.URL, value)
+		case "description":
+			m.Description = mergeString(m.Description, value)
+		}
+	}
+	return m
+}
+
+// person formats a name and an email as "name <email>"
+func person(name, email string) string {
+	if email == "" {
+		return name
+	}
+	return strings.TrimSpace(name + " <" + email + ">")
+}
+
+func packageJSONMetadata(data []byte) (m FPMBuildMetadata) {
+	var pkg struct {
+		Description string          `json:"description"`
+		License     json.RawMessage `json:"license"`
+		Homepage    string          `json:"homepage"`
+		Author      json.RawMessage `json:"author"`
+	}
+	err := json.Unmarshal(data, &pkg)
+	if err != nil {
+		log.Printf("package.json: %v", err)
+		return m
+	}
+	m.Description = pkg.Description
+	m.URL = pkg.Homepage
+
+	var license struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(pkg.License, &m.License) != nil &&
+		json.Unmarshal(pkg.License, &license) == nil {
+		m.License = license.Type
+	}
+
+	var author struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(pkg.Author, &m.Maintainer) != nil &&
+		json.Unmarshal(pkg.Author, &author) == nil {
+		m.Maintainer = person(author.Name, author.Email)
+	}
+	return m
+}
+
+var (
+	tomlSection = regexp.MustCompile(`^\s*\[([^\]]+)\]\s*$`)
+	tomlKey     = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	tomlString  = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"|'([^']*)'`)
+)
+
+// tomlValues returns the first string of each key of a TOML section. Only
+// the simple syntax of common project files is understood.
+func tomlValues(data []byte, section string) map[string]string {
+	res := map[string]string{}
+	current := ""
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := tomlSection.FindStringSubmatch(line); m != nil {
+			current = strings.TrimSpace(m[1])
+			continue
+		}
+		if current != section {
+			continue
+		}
+		m := tomlKey.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if strings.HasPrefix(m[2], "{") && strings.Contains(m[2], "file") {
+			// Reference to a file (license = {file = "LICENSE"})
+			continue
+		}
+		if s := tomlString.FindStringSubmatch(m[2]); s != nil {
+			res[m[1]] = s[1] + s[2]
+		}
+	}
+	return res
+}
+
+var tomlPerson = regexp.MustCompile(`name\s*=\s*"([^"]*)"(?:\s*,\s*email\s*=\s*"([^"]*)")?`)
+
+func cargoMetadata(data []byte) (m FPMBuildMetadata) {
+	pkg := tomlValues(data, "package")
+	m.Description = pkg["description"]
+	m.License = pkg["license"]
+	m.URL = mergeString(pkg["homepage"], pkg["repository"])
+	m.Maintainer = pkg["authors"]
+	return m
+}
+
+func pyprojectMetadata(data []byte) (m FPMBuildMetadata) {
+	project := tomlValues(data, "project")
+	m.Description = project["description"]
+	m.License = project["license"]
+	urls := tomlValues(data, "project.urls")
+	m.URL = mergeString(urls["Homepage"], urls["homepage"])
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.Contains(line, "{") {
+			continue
+		}
+		if p := tomlPerson.FindStringSubmatch(line); p != nil {
+			m.Maintainer = person(p[1], p[2])
+			break
+		}
+	}
+	return m
+}
+
+var setupPyKeyword = regexp.MustCompile(`\b(description|license|url|author|author_email|maintainer|maintainer_email)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+
+func setupPyMetadata(data []byte) (m FPMBuildMetadata) {
+	kw := map[string]string{}
+	for _, match := range setupPyKeyword.FindAllStringSubmatch(string(data), -1) {
+		if _, ok := kw[match[1]]; !ok {
+			kw[match[1]] = match[2] + match[3]
+		}
+	}
+	m.Description = kw["description"]
+	m.License = kw["license"]
+	m.URL = kw["url"]
+	if kw["maintainer"] != "" {
+		m.Maintainer = person(kw["maintainer"], kw["maintainer_email"])
+	} else if kw["author"] != "" {
+		m.Maintainer = person(kw["author"], kw["author_email"])
+	}
+	return m
+}
+
+func goModMetadata(data []byte) (m FPMBuildMetadata) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "module" {
+			continue
+		}
+		module := strings.Trim(fields[1], `"`)
+		if host := strings.SplitN(module, "/", 2)[0]; strings.Contains(host, ".") {
+			m.URL = "https://" + module
+		}
+		break
+	}
+	return m
+}
@@ -0,0 +1,105 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FPMOutput is one of the packages split from a single build
+type FPMOutput struct {
+	Suffix  string            `yaml:"suffix" doc:"Appended to the package name (-dev, -doc, ...). Empty for the main package"`
+	Paths   []string          `yaml:"paths" doc:"Glob patterns of the files going to this package, relative to the package chdir. An output without paths receives the files not matched by other outputs"`
+	Depends []string          `yaml:"depends" doc:"Dependencies. Dependencies on other outputs are pinned to the version being built"`
+	Hooks   map[string]string `yaml:"fpm-hooks" doc:"fpm scripts of this package, merged with the fpm-hooks of the build"`
+}
+
+// validateOutputs checks that the outputs can be used with the package
+// options: their paths are relative to package.chdir, which fpm also changes
+// to, and they replace package.paths
+func validateOutputs(pkg *FPMPackage, outputs []FPMOutput) error {
+	if len(outputs) == 0 {
+		return nil
+	} else if pkg.Chdir == "" {
+		return fmt.Errorf("outputs: package.chdir must be set, the paths of the outputs are relative to it")
+	} else if len(pkg.Paths) > 0 {
+		return fmt.Errorf("outputs: package.paths cannot be used with outputs, set the paths of the outputs instead")
+	}
+	return nil
+}
+
+// outputInputs returns for each output the list of files it contains,
+// relative to root
+func outputInputs(root string, outputs []FPMOutput) ([][]string, error) {
+	res := make([][]string, len(outputs))
+	var claimed []string
+	rest := -1
+	for i, output := range outputs {
+		if len(output.Paths) == 0 {
+			if rest != -1 {
+				return nil, fmt.Errorf("outputs %q and %q both have no paths", outputs[rest].Suffix, output.Suffix)
+			}
+			rest = i
+			continue
+		}
+		for _, pattern := range output.Paths {
+			matches, err := filepath.Glob(filepath.Join(root, pattern))
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matches {
+				rel, err := filepath.Rel(root, m)
+				if err != nil {
+					return nil, err
+				}
+				res[i] = append(res[i], rel)
+				claimed = append(claimed, rel)
+			}
+		}
+		if len(res[i]) == 0 {
+			return nil, fmt.Errorf("output %q: no file matches %s", output.Suffix, strings.Join(output.Paths, " "))
+		}
+	}
+	if rest == -1 {
+		return res, nil
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		for _, c := range claimed {
+			if rel == c && info.IsDir() {
+				return filepath.SkipDir
+			} else if rel == c {
+				return nil
+			}
+		}
+		if !info.IsDir() {
+			res[rest] = append(res[rest], rel)
+		}
+		return nil
+	})
+	sort.Strings(res[rest])
+	return res, err
+}
+
+// pinDepends pins a dependency on another output to the exact version
+func pinDepends(dep, name, version string, outputs []FPMOutput) string {
+	if version == "" {
+		return dep
+	}
+	for _, output := range outputs {
+		if dep == name+output.Suffix {
+			return dep + " = " + version
+		}
+	}
+	return dep
+}
@@ -0,0 +1,44 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+// FPMPackage describes the fpm options in a structured way. The lists are
+// appended to the lists of the configuration they override, and entries
+// starting with - remove the inherited entry.
+type FPMPackage struct {
+	Source      string   `yaml:"source" doc:"Input type (fpm option -s)"`
+	Chdir       string   `yaml:"chdir" doc:"Change to this directory before searching for files (fpm option -C)"`
+	Depends     []string `yaml:"depends" merge:"append" doc:"Dependencies (fpm option --depends)"`
+	Conflicts   []string `yaml:"conflicts" merge:"append" doc:"Conflicting packages (fpm option --conflicts)"`
+	Provides    []string `yaml:"provides" merge:"append" doc:"Provided packages (fpm option --provides)"`
+	Replaces    []string `yaml:"replaces" merge:"append" doc:"Replaced packages (fpm option --replaces)"`
+	ConfigFiles []string `yaml:"config-files" merge:"append" doc:"Configuration files (fpm option --config-files)"`
+	Directories []string `yaml:"directories" merge:"append" doc:"Directories owned by the package (fpm option --directories)"`
+	Paths       []string `yaml:"paths" merge:"append" doc:"Files to package, relative to chdir"`
+}
+
+// Args returns the fpm options, without the paths
+func (p *FPMPackage) Args() []string {
+	var args []string
+	if p.Source != "" {
+		args = append(args, "-s", p.Source)
+	}
+	if p.Chdir != "" {
+		args = append(args, "-C", p.Chdir)
+	}
+	for _, opt := range []struct {
+		flag   string
+		values []string
+	}{
+		{"--depends", p.Depends},
+		{"--conflicts", p.Conflicts},
+		{"--provides", p.Provides},
+		{"--replaces", p.Replaces},
+		{"--config-files", p.ConfigFiles},
+		{"--directories", p.Directories},
+	} {
+		for _, v := range opt.values {
+			args = append(args, opt.flag, v)
+		}
+	}
+	return args
+}
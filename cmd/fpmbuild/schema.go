@@ -0,0 +1,19 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"internal/fpmconfig"
+)
+
+// Schema returns the JSON Schema of the configuration files, generated from
+// the configuration types. Descriptions are taken from the doc tag of the
+// fields and defaults from defaultFile.
+func Schema() ([]byte, error) {
+	schema := fpmconfig.TypeSchema(reflect.TypeOf(defaultFile), reflect.ValueOf(defaultFile))
+	schema["$schema"] = fpmconfig.SchemaURL
+	schema["title"] = "fpmbuild configuration (.fpmbuild.yaml)"
+	return json.MarshalIndent(schema, "", "  ")
+}
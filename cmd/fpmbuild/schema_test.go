@@ -0,0 +1,24 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestSchemaFile fails when fpmbuild.schema.json is not the output of
+// fpmbuild -schema, run make schema to update it
+func TestSchemaFile(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.ReadFile("../../fpmbuild.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(schema, '\n'), file) {
+		t.Error("fpmbuild.schema.json is out of date, run make schema")
+	}
+}
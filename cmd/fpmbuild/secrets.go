@@ -0,0 +1,80 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Secrets are mounted read-only in the build container under this directory
+const secretsPath = "/run/secrets"
+
+// Secret is a file made available to the build under its name in the secrets
+// directory. Its content is taken from a host file or a host environment
+// variable.
+type Secret struct {
+	Name string `yaml:"name" doc:"File name of the secret"`
+	File string `yaml:"file" doc:"Host file containing the secret"`
+	Env  string `yaml:"env" doc:"Host environment variable containing the secret"`
+}
+
+// secretValues are masked in logged command lines
+var secretValues []string
+
+// writeSecrets writes the secrets in a new temporary directory, to be removed
+// by the caller
+func writeSecrets(secrets []Secret) (string, error) {
+	dir, err := ioutil.TempDir("", "fpmbuild-secrets")
+	if err != nil {
+		return "", err
+	}
+	for _, s := range secrets {
+		var value []byte
+		if s.Name == "" || strings.ContainsRune(s.Name, '/') {
+			err = fmt.Errorf("invalid secret name %q", s.Name)
+		} else if s.File != "" {
+			value, err = ioutil.ReadFile(s.File)
+		} else if s.Env != "" {
+			v, ok := os.LookupEnv(s.Env)
+			if !ok {
+				err = fmt.Errorf("secret %s: environment variable %s is not set", s.Name, s.Env)
+			}
+			value = []byte(v)
+		} else {
+			err = fmt.Errorf("secret %s: no file or env specified", s.Name)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, s.Name), value, 0400)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		if v := strings.TrimSpace(string(value)); v != "" {
+			secretValues = append(secretValues, v)
+		}
+	}
+	return dir, nil
+}
+
+// mask hides the secret values in s
+func mask(s string) string {
+	for _, v := range secretValues {
+		s = strings.Replace(s, v, "********", -1)
+	}
+	return s
+}
+
+// environ converts variables to a sorted list of KEY=VALUE strings
+func environ(variables map[string]string) []string {
+	var res []string
+	for k, v := range variables {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
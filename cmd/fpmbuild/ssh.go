@@ -0,0 +1,45 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Location of the forwarded ssh-agent socket and of the known_hosts file in
+// the build container
+const (
+	sshAgentPath   = "/run/ssh/agent.sock"
+	knownHostsPath = "/run/ssh/known_hosts"
+)
+
+// sshCommand returns the ssh command for GIT_SSH_COMMAND that only accepts
+// hosts listed in the knownHosts file
+func sshCommand(knownHosts string) string {
+	return fmt.Sprintf("ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s", shellEscape(knownHosts))
+}
+
+// setupSSH forwards the ssh-agent and the known_hosts file to the container
+func (env *DockerEnvironment) setupSSH(variables map[string]string) error {
+	if env.SSHAgent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return fmt.Errorf("ssh-agent: SSH_AUTH_SOCK is not set")
+		}
+		env.Volumes = append(env.Volumes, sock+":"+sshAgentPath)
+		variables["SSH_AUTH_SOCK"] = sshAgentPath
+	}
+	if env.KnownHosts != "" {
+		knownHosts, err := filepath.Abs(env.KnownHosts)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(knownHosts); err != nil {
+			return err
+		}
+		env.Volumes = append(env.Volumes, knownHosts+":"+knownHostsPath+":ro")
+		variables["GIT_SSH_COMMAND"] = sshCommand(knownHostsPath)
+	}
+	return nil
+}
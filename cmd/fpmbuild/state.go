@@ -0,0 +1,54 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BuildState is kept between builds of a package to number the successive
+// builds of the same version
+type BuildState struct {
+	Version   string `yaml:"version"`
+	Iteration int    `yaml:"iteration"`
+}
+
+// defaultStateFile returns the state file next to the source directory
+func defaultStateFile() string {
+	path, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(path), filepath.Base(path)+".fpmbuild-state")
+}
+
+// nextIteration returns the state for a new build of version. The iteration
+// is reset when the version changes.
+func nextIteration(statefile, version string) (BuildState, error) {
+	var state BuildState
+	err := readYAML(statefile, &state)
+	if err != nil && !os.IsNotExist(err) {
+		return state, err
+	}
+	if state.Version != version {
+		state = BuildState{Version: version}
+	}
+	state.Iteration++
+	return state, nil
+}
+
+func writeState(statefile string, state BuildState) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(statefile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
@@ -0,0 +1,122 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"internal/fpmconfig"
+)
+
+// TemplateData is given to the templates of the configuration strings
+type TemplateData struct {
+	Name    string
+	Version string
+	Target  string
+	// Source directory, in the container for docker builds
+	SrcPath string
+	// Commit id of the source, empty if it is not a git repository
+	GitRev string
+	// User defined variables (vars section)
+	Vars map[string]string
+}
+
+// expandTemplates evaluates the strings of the configuration as templates.
+// The variables are evaluated first and can be used in the other strings.
+// Fields tagged template:"-" are left as is.
+func expandTemplates(fpmbuild *FPMBuildFile, data *TemplateData) error {
+	vars := reflect.ValueOf(map[string]string{})
+	for k, v := range fpmbuild.Vars {
+		vars.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+	}
+	data.Vars = fpmbuild.Vars
+	err := expandValue(vars, "vars", data)
+	if err != nil {
+		return err
+	}
+	data.Vars = vars.Interface().(map[string]string)
+	fpmbuild.Vars = data.Vars
+	return expandValue(reflect.ValueOf(fpmbuild).Elem(), "", data)
+}
+
+func expandValue(v reflect.Value, path string, data *TemplateData) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandValue(v.Elem(), path, data)
+		}
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := fpmconfig.YAMLName(f)
+			if name == "" || f.Tag.Get("template") == "-" {
+				continue
+			}
+			err := expandValue(v.Field(i), fpmconfig.JoinPath(path, name), data)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			err := expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), data)
+			if err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			// Map elements are not addressable, expand a copy
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(k))
+			err := expandValue(elem, fpmconfig.JoinPath(path, fmt.Sprint(k.Interface())), data)
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(k, elem)
+		}
+
+	case reflect.String:
+		s, err := expandString(v.String(), path, data)
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	}
+	return nil
+}
+
+func expandString(s, path string, data *TemplateData) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New(path).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// gitRev returns the commit id of the source, or an empty string
+func gitRev() string {
+	var buf bytes.Buffer
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Stdout = &buf
+	if cmd.Run() != nil {
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
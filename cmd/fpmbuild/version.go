@@ -0,0 +1,214 @@
+// vim: ts=4:sw=4:sts=4
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type FPMBuildVersion struct {
+	Scheme     string `yaml:"scheme" template:"-" doc:"describe (default), tag, tag-distance, date or command"`
+	TagPattern string `yaml:"tag-pattern" template:"-" doc:"Only consider tags matching this glob pattern (git describe --match)"`
+	Command    string `yaml:"command" template:"-" doc:"Shell command printing the version, for the command scheme"`
+	Epoch      string `yaml:"epoch" doc:"Package epoch"`
+	Iteration  string `yaml:"iteration" doc:"Package iteration, defaults to a counter of the builds of the same version"`
+}
+
+// Version computes the package version according to the version scheme. It
+// returns an empty version if it cannot be determined.
+func (v *FPMBuildVersion) Version() (string, error) {
+	if v.Scheme == "command" {
+		return v.command()
+	}
+	if exec.Command("git", "rev-parse").Run() != nil {
+		if v.Scheme == "date" {
+			return time.Now().UTC().Format("20060102.150405"), nil
+		}
+		return "", nil
+	}
+	switch v.Scheme {
+	case "", "describe":
+		return v.describe()
+	case "tag":
+		return v.tag()
+	case "tag-distance":
+		return v.tagDistance()
+	case "date":
+		return v.date()
+	default:
+		return "", fmt.Errorf("unknown version scheme %s", v.Scheme)
+	}
+}
+
+func (v *FPMBuildVersion) command() (string, error) {
+	if v.Command == "" {
+		return "", fmt.Errorf("version scheme command: no command specified")
+	}
+	log.Printf("sh -c %s", shellEscape(v.Command))
+	var buf bytes.Buffer
+	cmd := exec.Command("sh", "-c", v.Command)
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// gitDescribe runs git describe, restricted to the tag pattern
+func (v *FPMBuildVersion) gitDescribe(args ...string) (string, error) {
+	if v.TagPattern != "" {
+		args = append(args, "--match", v.TagPattern)
+	}
+	var buf bytes.Buffer
+	cmd := exec.Command("git", append([]string{"describe"}, args...)...)
+	cmd.Stdout = &buf
+	err := cmd.Run()
+	return strings.TrimSpace(buf.String()), err
+}
+
+// describe keeps only alphanumerics from git describe, starting at the first
+// digit, and replaces everything else with dots. Falls back to 0.<sha>.
+func (v *FPMBuildVersion) describe() (string, error) {
+	dirtymark := dirtyMark()
+	desc, err := v.gitDescribe("--dirty=" + dirtymark)
+	if err == nil {
+		ver := ""
+		for _, b := range []byte(desc) {
+			if ver == "" {
+				if b >= '0' && b <= '9' {
+					ver += string([]byte{b})
+				}
+			} else if (b < '0' || b > '9') &&
+				(b < 'a' || b > 'z') &&
+				(b < 'A' || b > 'Z') {
+				ver += "."
+			} else {
+				ver += string([]byte{b})
+			}
+		}
+		return strings.TrimRight(ver, "."), nil
+	}
+
+	desc, err = v.gitDescribe("--dirty="+dirtymark, "--always", "--tags")
+	if err != nil {
+		return "", err
+	}
+	return "0." + desc, nil
+}
+
+var tagPrefix = regexp.MustCompile(`^[^0-9]*`)
+
+// tag uses the most recent tag, without its non numeric prefix
+func (v *FPMBuildVersion) tag() (string, error) {
+	tag, err := v.gitDescribe("--tags", "--abbrev=0")
+	if err != nil {
+		return "", err
+	}
+	return tagPrefix.ReplaceAllString(tag, ""), nil
+}
+
+var describeLong = regexp.MustCompile(`^(.*)-([0-9]+)-g([0-9a-f]+)$`)
+
+// tagDistance uses the most recent tag followed by the number of commits
+// since that tag and the commit id: 1.2.3+git5.gabcdef
+func (v *FPMBuildVersion) tagDistance() (string, error) {
+	desc, err := v.gitDescribe("--tags", "--long")
+	if err != nil {
+		return "", err
+	}
+	m := describeLong.FindStringSubmatch(desc)
+	if m == nil {
+		return "", fmt.Errorf("cannot parse git describe %s", desc)
+	}
+	ver := tagPrefix.ReplaceAllString(m[1], "")
+	if m[2] != "0" {
+		ver += "+git" + m[2] + ".g" + m[3]
+	}
+	if isDirty() {
+		dirty := dirtyMark()
+		if m[2] == "0" {
+			ver += "+" + strings.TrimPrefix(dirty, ".")
+		} else {
+			ver += dirty
+		}
+	}
+	return ver, nil
+}
+
+// date uses the date of the HEAD commit followed by the commit id
+func (v *FPMBuildVersion) date() (string, error) {
+	var buf bytes.Buffer
+	cmd := exec.Command("git", "log", "-1", "--format=%ct %h")
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+	var timestamp int64
+	var commit string
+	_, err = fmt.Sscan(buf.String(), &timestamp, &commit)
+	if err != nil {
+		return "", err
+	}
+	ver := time.Unix(timestamp, 0).UTC().Format("20060102.150405") + ".g" + commit
+	if isDirty() {
+		ver += dirtyMark()
+	}
+	return ver, nil
+}
+
+// isDirty tells if tracked files are modified in the working tree
+func isDirty() bool {
+	return exec.Command("git", "diff-index", "--quiet", "HEAD", "--").Run() != nil
+}
+
+// dirtyMark returns the suffix for modified working trees, containing the
+// hash of the working tree
+func dirtyMark() string {
+	dirtymark := ".dirty"
+	environ := os.Environ()
+	environ = append(environ, "GIT_INDEX_FILE=.git/index-fpm-dirty")
+	os.Remove(".git/index-fpm-dirty")
+	defer func() { os.Remove(".git/index-fpm-dirty") }()
+
+	cmd := exec.Command("git", "add", "-u")
+	cmd.Env = environ
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		log.Println(err)
+	} else {
+		cmd := exec.Command("git", "reset")
+		cmd.Env = environ
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if err == nil {
+		var hash bytes.Buffer
+		cmd := exec.Command("git", "write-tree")
+		cmd.Env = environ
+		cmd.Stdout = &hash
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			log.Println(err)
+		} else {
+			dirtymark += "." + string(hash.Bytes()[0:7])
+		}
+	}
+	return dirtymark
+}
@@ -0,0 +1,371 @@
+// vim: ts=4:sw=4:sts=4
+
+// Package fpmconfig reads the layered YAML configuration shared by fpmbuild
+// and fpmbot2: merge of the layers, validation and JSON Schema.
+package fpmconfig
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A Layer is a configuration file. Layers are merged in order, each layer
+// overriding the layers before it.
+//
+// Mappings are merged key by key, other values replace the inherited value.
+// Lists of fields tagged merge:"append" are appended to the inherited list
+// instead, and their entries starting with - remove the inherited entry. In
+// string maps, an empty string removes the inherited key. The YAML tags
+// !replace, !append and !remove override this behaviour for a value:
+//
+//	build: !replace {build: make}   # do not merge with the inherited build
+//	fpm: !append [--depends, foo]   # append to the inherited list
+//	cache: !remove [/tmp/ccache]    # remove from the inherited list
+//	clean: !remove                  # remove the inherited value
+type Layer struct {
+	Name string
+	Node *yaml.Node
+}
+
+// Tags controlling the merge of a value with the inherited value
+const (
+	TagReplace = "!replace"
+	TagAppend  = "!append"
+	TagRemove  = "!remove"
+)
+
+// ReadLayer reads a configuration file
+func ReadLayer(filename string) (*Layer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	var node *yaml.Node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		node = doc.Content[0]
+	}
+	return NodeLayer(filename, node)
+}
+
+// NodeLayer returns a layer made of a node of the file name, for a
+// configuration embedded in another file. A nil or null node is an empty
+// layer.
+func NodeLayer(name string, node *yaml.Node) (*Layer, error) {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if IsNull(node) {
+		node = &yaml.Node{Kind: yaml.MappingNode}
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: configuration must be a mapping", name, node.Line)
+	}
+	return &Layer{Name: name, Node: node}, nil
+}
+
+// IsNull tells if n is missing or a null value
+func IsNull(n *yaml.Node) bool {
+	return n == nil || n.Kind == 0 || n.Kind == yaml.ScalarNode && n.ShortTag() == "!!null"
+}
+
+// ObjectLayer returns a layer made of the YAML representation of obj
+func ObjectLayer(name string, obj interface{}) (*Layer, error) {
+	var node yaml.Node
+	err := node.Encode(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &Layer{Name: name, Node: &node}, nil
+}
+
+// SetLayer returns a layer setting a single value from a path.to.key=value
+// specification. The value is parsed as YAML.
+func SetLayer(spec string) (*Layer, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("-set %s: expected key=value", spec)
+	}
+	var value yaml.Node
+	err := yaml.Unmarshal([]byte(parts[1]), &value)
+	if err != nil {
+		return nil, fmt.Errorf("-set %s: %v", spec, err)
+	}
+	node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	if len(value.Content) > 0 {
+		node = value.Content[0]
+	}
+	clearLines(node)
+	keys := strings.Split(parts[0], ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		node = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: keys[i]},
+			node,
+		}}
+	}
+	return &Layer{Name: "-set " + parts[0], Node: node}, nil
+}
+
+// clearLines removes the line numbers so the origin of the values is only
+// the layer name
+func clearLines(n *yaml.Node) {
+	n.Line = 0
+	for _, child := range n.Content {
+		clearLines(child)
+	}
+}
+
+// MergeLayers validates and merges the layers and decodes the result in obj.
+// The merged node is returned with the origin of each value as line comment.
+func MergeLayers(layers []*Layer, obj interface{}) (*yaml.Node, error) {
+	t := reflect.TypeOf(obj).Elem()
+	schema := TypeSchema(t, reflect.Value{})
+	var errs []string
+	for _, layer := range layers {
+		if err := Validate(layer, schema); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	var res *yaml.Node
+	for _, layer := range layers {
+		res = MergeNode(res, layer.Node, t, "", layer.Name)
+	}
+	if res == nil {
+		res = &yaml.Node{Kind: yaml.MappingNode}
+	}
+	return res, res.Decode(obj)
+}
+
+// origin returns the location of a node for the print-config comments
+func origin(name string, n *yaml.Node) string {
+	if n.Line == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s:%d", name, n.Line)
+}
+
+// MergeNode merges src over dst, dst may be nil. t is the Go type the value
+// is decoded into and mode the value of its merge struct tag. The values of
+// the result are annotated with their origin, name.
+func MergeNode(dst, src *yaml.Node, t reflect.Type, mode, name string) *yaml.Node {
+	for src.Kind == yaml.AliasNode {
+		src = src.Alias
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if dst != nil && (dst.Kind != src.Kind || dst.ShortTag() == "!!null") {
+		dst = nil
+	}
+
+	switch src.Tag {
+	case TagReplace:
+		dst = nil
+	case TagRemove:
+		if src.Kind == yaml.SequenceNode && dst != nil {
+			res := CopyNode(dst)
+			res.Content = nil
+			for _, item := range dst.Content {
+				if !containsNode(src.Content, item) {
+					res.Content = append(res.Content, item)
+				}
+			}
+			return res
+		}
+		return nil
+	}
+
+	switch src.Kind {
+	case yaml.MappingNode:
+		res := &yaml.Node{Kind: yaml.MappingNode}
+		if dst != nil {
+			res = CopyNode(dst)
+		}
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			ft, fmode := childType(t, key.Value)
+			j := MappingIndex(res, key.Value)
+			var inherited *yaml.Node
+			if j >= 0 {
+				inherited = res.Content[j+1]
+			}
+			merged := MergeNode(inherited, value, ft, fmode, name)
+			if merged == nil || isStringMap(t) && value.Kind == yaml.ScalarNode && value.Value == "" {
+				if j >= 0 {
+					res.Content = append(res.Content[:j], res.Content[j+2:]...)
+				}
+			} else if j >= 0 {
+				res.Content[j+1] = merged
+			} else {
+				res.Content = append(res.Content, annotate(CopyNode(key), ""), merged)
+			}
+		}
+		return res
+
+	case yaml.SequenceNode:
+		res := annotate(CopyNode(src), name)
+		if mode == "append" {
+			var inherited []*yaml.Node
+			if dst != nil {
+				inherited = dst.Content
+			}
+			res.Content = removals(inherited, res.Content)
+		} else if src.Tag == TagAppend && dst != nil {
+			res.Content = append(append([]*yaml.Node{}, dst.Content...), res.Content...)
+		}
+		return res
+
+	default:
+		return annotate(CopyNode(src), name)
+	}
+}
+
+// removals appends the items not already present to list. Items starting
+// with - remove the matching entry from list instead.
+func removals(list, items []*yaml.Node) []*yaml.Node {
+	res := append([]*yaml.Node{}, list...)
+	for _, item := range items {
+		if isRemoval(item) {
+			var kept []*yaml.Node
+			for _, n := range res {
+				if n.Kind != yaml.ScalarNode || n.Value != item.Value[1:] {
+					kept = append(kept, n)
+				}
+			}
+			res = kept
+		} else if !containsNode(res, item) {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func isRemoval(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && strings.HasPrefix(n.Value, "-") && len(n.Value) > 1
+}
+
+func containsNode(list []*yaml.Node, n *yaml.Node) bool {
+	for _, item := range list {
+		if nodeString(item) == nodeString(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeString(n *yaml.Node) string {
+	if n.Kind == yaml.ScalarNode {
+		return n.Value
+	}
+	c := CopyNode(n)
+	annotate(c, "")
+	data, _ := yaml.Marshal(c)
+	return string(data)
+}
+
+// MappingIndex returns the index of the key in the content of a mapping, -1
+// if it is not there
+func MappingIndex(n *yaml.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// CopyNode returns a deep copy of n, line numbers included
+func CopyNode(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	c := *n
+	c.Anchor = ""
+	c.Content = nil
+	for _, child := range n.Content {
+		c.Content = append(c.Content, CopyNode(child))
+	}
+	return &c
+}
+
+// annotate removes the merge tags and sets the origin of the values as
+// comments
+func annotate(n *yaml.Node, name string) *yaml.Node {
+	switch n.Tag {
+	case TagReplace, TagAppend, TagRemove:
+		n.Tag = ""
+	}
+	n.Style &^= yaml.FlowStyle
+	n.HeadComment = ""
+	n.FootComment = ""
+	n.LineComment = ""
+	if n.Kind == yaml.ScalarNode && name != "" {
+		n.LineComment = origin(name, n)
+	}
+	for i, child := range n.Content {
+		if n.Kind == yaml.MappingNode && i%2 == 0 {
+			annotate(child, "")
+		} else {
+			annotate(child, name)
+		}
+	}
+	return n
+}
+
+// childType returns the type and merge mode of a mapping value
+func childType(t reflect.Type, key string) (reflect.Type, string) {
+	if t == nil {
+		return nil, ""
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem(), ""
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if YAMLName(f) == key {
+				return f.Type, f.Tag.Get("merge")
+			}
+		}
+	}
+	return nil, ""
+}
+
+func isStringMap(t reflect.Type) bool {
+	return t != nil && t.Kind() == reflect.Map && t.Elem().Kind() == reflect.String
+}
+
+// YAMLName returns the YAML key of a struct field, empty if the field is not
+// read from YAML
+func YAMLName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "-" {
+		return ""
+	} else if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
+
+// JoinPath returns the path of a key in the mapping at path
+func JoinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,126 @@
+// vim: ts=4:sw=4:sts=4
+package fpmconfig
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+type testConfig struct {
+	Clean   string            `yaml:"clean"`
+	FPM     []string          `yaml:"fpm"`
+	Depends []string          `yaml:"depends" merge:"append"`
+	Build   map[string]string `yaml:"build"`
+	Docker  *struct {
+		Image string `yaml:"image"`
+		CPUs  string `yaml:"cpus"`
+	} `yaml:"docker"`
+}
+
+func testNode(t *testing.T, data string) *yaml.Node {
+	var doc yaml.Node
+	err := yaml.Unmarshal([]byte(data), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc.Content[0]
+}
+
+func TestMergeNode(t *testing.T) {
+	base := `{clean: git clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`
+	tests := []struct {
+		layer string
+		want  string
+	}{
+		{`{}`, base},
+		{`{clean: make clean}`,
+			`{clean: make clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{fpm: [-C, root]}`,
+			`{clean: git clean, fpm: [-C, root], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{fpm: !append [-C, root]}`,
+			`{clean: git clean, fpm: [-s, dir, -C, root], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{fpm: !remove [dir]}`,
+			`{clean: git clean, fpm: [-s], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{depends: [libbar, libc6, -libfoo]}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libc6, libbar], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{depends: !replace [libbar]}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libbar], build: {build: make, install: make install}, docker: {image: debian, cpus: 2}}`},
+		{`{build: {build: ninja, install: ""}}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: ninja}, docker: {image: debian, cpus: 2}}`},
+		{`{build: !replace {build: ninja}}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: ninja}, docker: {image: debian, cpus: 2}}`},
+		{`{docker: {cpus: 4}}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {image: debian, cpus: 4}}`},
+		{`{docker: !remove , clean: !remove }`,
+			`{fpm: [-s, dir], depends: [libc6, libfoo], build: {build: make, install: make install}}`},
+		{`{docker: {image: !remove }}`,
+			`{clean: git clean, fpm: [-s, dir], depends: [libc6, libfoo], build: {build: make, install: make install}, docker: {cpus: 2}}`},
+	}
+	typ := reflect.TypeOf(testConfig{})
+	for _, test := range tests {
+		merged := MergeNode(nil, testNode(t, base), typ, "", "base")
+		merged = MergeNode(merged, testNode(t, test.layer), typ, "", "layer")
+		var got, want testConfig
+		err := merged.Decode(&got)
+		if err != nil {
+			t.Errorf("%s: %v", test.layer, err)
+			continue
+		}
+		err = testNode(t, test.want).Decode(&want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", test.layer, got, want)
+		}
+	}
+}
+
+func TestMergeNodeOrigin(t *testing.T) {
+	typ := reflect.TypeOf(testConfig{})
+	merged := MergeNode(nil, testNode(t, "clean: git clean\ndepends: [libc6]\n"), typ, "", "base")
+	merged = MergeNode(merged, testNode(t, "depends: [libfoo]\n"), typ, "", "layer")
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "clean: git clean # base:1\ndepends:\n    - libc6 # base:2\n    - libfoo # layer:1\n"
+	if string(data) != want {
+		t.Errorf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestRemovals(t *testing.T) {
+	tests := []struct {
+		list, items string
+		want        string
+	}{
+		{"", "a b", "a b"},
+		{"a b", "c", "a b c"},
+		{"a b", "b c", "a b c"},
+		{"a b c", "-b", "a c"},
+		{"a b", "-c", "a b"},
+		{"a b", "-a a", "b a"},
+		{"a b", "-", "a b -"},
+		{"a -b", "c", "a -b c"},
+	}
+	nodes := func(s string) []*yaml.Node {
+		var res []*yaml.Node
+		for _, value := range strings.Fields(s) {
+			res = append(res, &yaml.Node{Kind: yaml.ScalarNode, Value: value})
+		}
+		return res
+	}
+	for _, test := range tests {
+		var got []string
+		for _, n := range removals(nodes(test.list), nodes(test.items)) {
+			got = append(got, n.Value)
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("removals(%q, %q) = %q, want %q", test.list, test.items, strings.Join(got, " "), test.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// vim: ts=4:sw=4:sts=4
+package fpmconfig
+
+import (
+	"reflect"
+)
+
+// SchemaURL is the JSON Schema draft the generated schemas conform to
+const SchemaURL = "http://json-schema.org/draft-07/schema#"
+
+// TypeSchema returns the JSON Schema of a configuration type. Descriptions
+// are taken from the doc tag of the fields. def is the default value, it may
+// be invalid if there is no default.
+func TypeSchema(t reflect.Type, def reflect.Value) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		if def.IsValid() {
+			if def.IsNil() {
+				def = reflect.Value{}
+			} else {
+				def = def.Elem()
+			}
+		}
+	}
+
+	schema := map[string]interface{}{}
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := YAMLName(f)
+			if name == "" {
+				continue
+			}
+			var fdef reflect.Value
+			if def.IsValid() {
+				fdef = def.Field(i)
+			}
+			prop := TypeSchema(f.Type, fdef)
+			if doc := f.Tag.Get("doc"); doc != "" {
+				prop["description"] = doc
+			}
+			properties[name] = prop
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+		return schema
+
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = TypeSchema(t.Elem(), reflect.Value{})
+
+	case reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = TypeSchema(t.Elem(), reflect.Value{})
+
+	case reflect.Bool:
+		schema["type"] = "boolean"
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+
+	default:
+		// YAML numbers such as cpus: 2 are accepted as strings
+		schema["type"] = []string{"string", "number"}
+	}
+
+	if def.IsValid() && !def.IsZero() && !(t.Kind() == reflect.Slice && def.Len() == 0) {
+		schema["default"] = def.Interface()
+	}
+	return schema
+}
@@ -0,0 +1,191 @@
+// vim: ts=4:sw=4:sts=4
+package fpmconfig
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validate checks that a layer only contains keys known to the JSON Schema
+// and values of the expected type. All the problems are reported, each
+// prefixed with the file and line.
+func Validate(layer *Layer, schema map[string]interface{}) error {
+	var errs []string
+	validateNode(layer.Node, schema, "", func(n *yaml.Node, msg string) {
+		errs = append(errs, origin(layer.Name, n)+": "+msg)
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// validateNode checks n against the schema. Null values and values tagged
+// !remove are always valid.
+func validateNode(n *yaml.Node, schema map[string]interface{}, path string, report func(*yaml.Node, string)) {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	types := schemaTypes(schema)
+	if len(types) == 0 || n.Tag == TagRemove || IsNull(n) {
+		return
+	}
+	where := ""
+	if path != "" {
+		where = path + ": "
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		if !types["object"] {
+			report(n, where+"expected "+typeNames(types)+", got "+kindName(n))
+			return
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		var keys []string
+		for key := range properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if prop, ok := properties[key.Value].(map[string]interface{}); ok {
+				validateNode(value, prop, JoinPath(path, key.Value), report)
+			} else if additional != nil {
+				validateNode(value, additional, JoinPath(path, key.Value), report)
+			} else if schema["additionalProperties"] == false {
+				msg := fmt.Sprintf("unknown key %q", key.Value)
+				if path != "" {
+					msg += " in " + path
+				}
+				if s := closest(key.Value, keys); s != "" {
+					msg += fmt.Sprintf(", did you mean %q?", s)
+				}
+				report(key, msg)
+			}
+		}
+
+	case yaml.SequenceNode:
+		if !types["array"] {
+			report(n, where+"expected "+typeNames(types)+", got "+kindName(n))
+			return
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range n.Content {
+				validateNode(item, items, fmt.Sprintf("%s[%d]", path, i), report)
+			}
+		}
+
+	default:
+		value := *n
+		if value.Tag == TagAppend || value.Tag == TagReplace {
+			value.Tag = ""
+		}
+		tag := value.ShortTag()
+		ok := types["string"] ||
+			types["number"] && (tag == "!!int" || tag == "!!float") ||
+			types["integer"] && tag == "!!int" ||
+			types["boolean"] && tag == "!!bool"
+		if !ok {
+			report(n, fmt.Sprintf("%sexpected %s, got %q", where, typeNames(types), n.Value))
+		}
+	}
+}
+
+// schemaTypes returns the JSON types allowed by the schema
+func schemaTypes(schema map[string]interface{}) map[string]bool {
+	types := map[string]bool{}
+	switch t := schema["type"].(type) {
+	case string:
+		types[t] = true
+	case []string:
+		for _, name := range t {
+			types[name] = true
+		}
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok {
+				types[name] = true
+			}
+		}
+	}
+	return types
+}
+
+func kindName(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
+}
+
+func typeNames(types map[string]bool) string {
+	names := map[string]string{
+		"object":  "a mapping",
+		"array":   "a list",
+		"string":  "a string",
+		"number":  "a number",
+		"integer": "an integer",
+		"boolean": "a boolean (true or false)",
+	}
+	var res []string
+	for _, t := range []string{"object", "array", "string", "number", "integer", "boolean"} {
+		// Numbers are accepted as strings
+		if types[t] && !(t == "number" && types["string"]) {
+			res = append(res, names[t])
+		}
+	}
+	return strings.Join(res, " or ")
+}
+
+// closest returns the candidate nearest to key if it looks like a typo
+func closest(key string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		d := editDistance(strings.ToLower(key), strings.ToLower(c))
+		if d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}